@@ -0,0 +1,81 @@
+package copr
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const cgroupMax = "max"
+
+// CgroupConfig configures the cgroup v2 limits of a unit
+type CgroupConfig struct {
+	// MemoryMax is written to memory.max, e.g. "512M" or "max"
+	MemoryMax string `json:"memory-max,omitempty"`
+	// CPUMax is written to cpu.max, e.g. "50000 100000" for half a CPU or "max"
+	CPUMax string `json:"cpu-max,omitempty"`
+	// PidsMax is written to pids.max. 0 means no limit
+	PidsMax int `json:"pids-max,omitempty"`
+}
+
+func (cc CgroupConfig) Validate() error {
+	if _, err := cc.memoryMax(); err != nil {
+		return err
+	}
+	if _, err := cc.cpuMax(); err != nil {
+		return err
+	}
+	if cc.PidsMax < 0 {
+		return errors.Errorf("pids-max must not be negative")
+	}
+	return nil
+}
+
+// memoryMax returns the value for memory.max or an empty string, if not configured
+func (cc CgroupConfig) memoryMax() (string, error) {
+	if cc.MemoryMax == "" || cc.MemoryMax == cgroupMax {
+		return cc.MemoryMax, nil
+	}
+	v, err := parseSize(cc.MemoryMax)
+	if err != nil {
+		return "", errors.Wrap(err, "memory-max")
+	}
+	return strconv.FormatUint(v, 10), nil
+}
+
+// cpuMax returns the value for cpu.max or an empty string, if not configured
+func (cc CgroupConfig) cpuMax() (string, error) {
+	fs := strings.Fields(cc.CPUMax)
+	if len(fs) == 0 {
+		return "", nil
+	}
+	if len(fs) > 2 {
+		return "", errors.Errorf("cpu-max: invalid value %q", cc.CPUMax)
+	}
+	if fs[0] != cgroupMax {
+		if v, err := strconv.ParseUint(fs[0], 10, 64); err != nil || v == 0 {
+			return "", errors.Errorf("cpu-max: invalid quota %q", fs[0])
+		}
+	}
+	if len(fs) == 2 {
+		if v, err := strconv.ParseUint(fs[1], 10, 64); err != nil || v == 0 {
+			return "", errors.Errorf("cpu-max: invalid period %q", fs[1])
+		}
+	}
+	return strings.Join(fs, " "), nil
+}
+
+func (cc CgroupConfig) pidsMax() string {
+	if cc.PidsMax == 0 {
+		return cgroupMax
+	}
+	return strconv.Itoa(cc.PidsMax)
+}
+
+// cgroupStats are usage values read from a cgroup
+type cgroupStats struct {
+	memoryCurrent uint64
+	cpuUsageUsec  uint64
+	oomKills      uint64
+}
@@ -0,0 +1,134 @@
+//go:build linux
+// +build linux
+
+package copr
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mazzegi/log"
+	"github.com/pkg/errors"
+)
+
+// setupCgroup creates the cgroup name under the delegated root and applies the limits of cc.
+// It returns the path of the cgroup.
+func setupCgroup(root string, name string, cc CgroupConfig) (string, error) {
+	// enable the controllers for the children of root - this fails, if they are already enabled or not delegated
+	err := writeCgroupFile(root, "cgroup.subtree_control", "+memory +cpu +pids")
+	if err != nil {
+		log.Debugf("cgroup: enable controllers in %q: %v", root, err)
+	}
+
+	path := filepath.Join(root, name)
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "mkdir cgroup %q", path)
+	}
+	memMax, err := cc.memoryMax()
+	if err != nil {
+		return "", err
+	}
+	if memMax == "" {
+		memMax = cgroupMax
+	}
+	cpuMax, err := cc.cpuMax()
+	if err != nil {
+		return "", err
+	}
+	if cpuMax == "" {
+		cpuMax = cgroupMax
+	}
+	limits := []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", memMax},
+		{"cpu.max", cpuMax},
+		{"pids.max", cc.pidsMax()},
+	}
+	for _, l := range limits {
+		err := writeCgroupFile(path, l.file, l.value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+func writeCgroupFile(path string, file string, value string) error {
+	fp := filepath.Join(path, file)
+	err := os.WriteFile(fp, []byte(value), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "write %q to %q", value, fp)
+	}
+	return nil
+}
+
+// openCgroup opens the cgroup dir at path to spawn processes into it
+func openCgroup(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open cgroup %q", path)
+	}
+	return f, nil
+}
+
+// removeCgroup removes the cgroup at path, which must not contain processes anymore
+func removeCgroup(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove cgroup %q", path)
+	}
+	return nil
+}
+
+// readCgroupStats reads the usage values of the cgroup at path
+func readCgroupStats(path string) (cgroupStats, error) {
+	var cs cgroupStats
+	bs, err := os.ReadFile(filepath.Join(path, "memory.current"))
+	if err != nil {
+		return cs, errors.Wrap(err, "read memory.current")
+	}
+	cs.memoryCurrent, _ = strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+
+	cpuStat, err := readCgroupKeyValues(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return cs, errors.Wrap(err, "read cpu.stat")
+	}
+	cs.cpuUsageUsec = cpuStat["usage_usec"]
+
+	memEvents, err := readCgroupKeyValues(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return cs, errors.Wrap(err, "read memory.events")
+	}
+	cs.oomKills = memEvents["oom_kill"]
+	return cs, nil
+}
+
+// readCgroupKeyValues reads flat keyed files like cpu.stat
+func readCgroupKeyValues(file string) (map[string]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	kvs := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fs[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		kvs[fs[0]] = v
+	}
+	return kvs, scanner.Err()
+}
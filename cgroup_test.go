@@ -0,0 +1,137 @@
+package copr
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCgroupConfig(t *testing.T) {
+	tests := map[string]struct {
+		cc      CgroupConfig
+		memMax  string
+		cpuMax  string
+		invalid bool
+	}{
+		"empty":     {cc: CgroupConfig{}, memMax: "", cpuMax: ""},
+		"max":       {cc: CgroupConfig{MemoryMax: "max", CPUMax: "max"}, memMax: "max", cpuMax: "max"},
+		"sizes":     {cc: CgroupConfig{MemoryMax: "512M", CPUMax: "50000 100000"}, memMax: "536870912", cpuMax: "50000 100000"},
+		"bytes":     {cc: CgroupConfig{MemoryMax: "1024"}, memMax: "1024"},
+		"bad-mem":   {cc: CgroupConfig{MemoryMax: "lots"}, invalid: true},
+		"bad-cpu":   {cc: CgroupConfig{CPUMax: "half"}, invalid: true},
+		"bad-pids":  {cc: CgroupConfig{PidsMax: -1}, invalid: true},
+		"cpu-zero":  {cc: CgroupConfig{CPUMax: "0 100000"}, invalid: true},
+		"cpu-extra": {cc: CgroupConfig{CPUMax: "1 2 3"}, invalid: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.cc.Validate()
+			if test.invalid {
+				assertErr(t, err, "validate")
+				return
+			}
+			assertNoErr(t, err, "validate")
+			memMax, _ := test.cc.memoryMax()
+			assertEqual(t, test.memMax, memMax, "memory-max")
+			cpuMax, _ := test.cc.cpuMax()
+			assertEqual(t, test.cpuMax, cpuMax, "cpu-max")
+		})
+	}
+}
+
+func TestSetupCgroup(t *testing.T) {
+	// cgroupfs files are plain files in a temp dir
+	root := t.TempDir()
+	path, err := setupCgroup(root, "unit", CgroupConfig{MemoryMax: "1K", PidsMax: 10})
+	assertNoErr(t, err, "setup-cgroup")
+	assertEqual(t, filepath.Join(root, "unit"), path, "path")
+
+	read := func(file string) string {
+		bs, err := os.ReadFile(filepath.Join(path, file))
+		assertNoErr(t, err, "read %q", file)
+		return string(bs)
+	}
+	assertEqual(t, "1024", read("memory.max"), "memory.max")
+	assertEqual(t, "max", read("cpu.max"), "cpu.max")
+	assertEqual(t, "10", read("pids.max"), "pids.max")
+
+	os.WriteFile(filepath.Join(path, "memory.current"), []byte("4096\n"), 0644)
+	os.WriteFile(filepath.Join(path, "cpu.stat"), []byte("usage_usec 1500\nuser_usec 1000\n"), 0644)
+	os.WriteFile(filepath.Join(path, "memory.events"), []byte("low 0\noom 2\noom_kill 1\n"), 0644)
+	cs, err := readCgroupStats(path)
+	assertNoErr(t, err, "read-cgroup-stats")
+	assertEqual(t, cgroupStats{memoryCurrent: 4096, cpuUsageUsec: 1500, oomKills: 1}, cs, "stats")
+}
+
+// cgroup2Mount returns the mount point of the cgroup v2 hierarchy or an empty string
+func cgroup2Mount() string {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) >= 3 && fs[2] == "cgroup2" {
+			return fs[1]
+		}
+	}
+	return ""
+}
+
+func TestGuardCgroupSpawn(t *testing.T) {
+	mount := cgroup2Mount()
+	if mount == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	// the limits don't matter here, so the controllers needn't be delegated
+	path := filepath.Join(mount, fmt.Sprintf("copr-test-%d", os.Getpid()))
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Skipf("cgroup v2 not writable: %v", err)
+	}
+	defer func() {
+		// the killed processes leave the cgroup asynchronously
+		for i := 0; i < 20 && removeCgroup(path) != nil; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	guard, err := NewGuard(
+		"/bin/sh",
+		// the child is forked right away
+		WithArgs("-c", fmt.Sprintf("sleep 60 & echo $! > %s; wait", pidFile)),
+		WithCgroup(path),
+		WithKillMode(KillModeGroup),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	<-time.After(200 * time.Millisecond)
+	bs, err := os.ReadFile(pidFile)
+	assertNoErr(t, err, "read pid-file")
+	childPID, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	assertNoErr(t, err, "parse child pid")
+
+	procs, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	assertNoErr(t, err, "read cgroup.procs")
+	inCgroup := map[string]bool{}
+	for _, p := range strings.Fields(string(procs)) {
+		inCgroup[p] = true
+	}
+	assertEqual(t, true, inCgroup[strconv.Itoa(pid)], "main process in cgroup")
+	assertEqual(t, true, inCgroup[strconv.Itoa(childPID)], "child process in cgroup")
+	assertNoErr(t, guard.Stop(), "guard-stop")
+}
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -99,7 +103,11 @@ func (clt *client) get(urlPath string) (copr.CTLResponse, error) {
 }
 
 func (clt *client) post(urlPath string, body io.Reader) (copr.CTLResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	return clt.postTimeout(urlPath, body, 10*time.Second)
+}
+
+func (clt *client) postTimeout(urlPath string, body io.Reader, timeout time.Duration) (copr.CTLResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	url := fmt.Sprintf("http://%s/%s", clt.host, urlPath)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
@@ -141,8 +149,26 @@ func (clt *client) exec(cmd string, args []string) (copr.CTLResponse, error) {
 			return copr.CTLResponse{}, errors.Errorf("usage: disable <unit-name>")
 		}
 		return clt.post(fmt.Sprintf("disable?unit=%s", args[0]), nil)
+	case "restart":
+		if len(args) != 1 {
+			return copr.CTLResponse{}, errors.Errorf("usage: restart <unit-name>")
+		}
+		return clt.postTimeout(fmt.Sprintf("restart?unit=%s", args[0]), nil, time.Minute)
+	case "restart-all":
+		return clt.restartAll(args)
+	case "reload":
+		if len(args) != 1 {
+			return copr.CTLResponse{}, errors.Errorf("usage: reload <unit-name>")
+		}
+		return clt.post(fmt.Sprintf("reload?unit=%s", args[0]), nil)
+	case "signal":
+		return clt.signal(args)
+	case "remove":
+		return clt.remove(args)
 	case "deploy":
 		return clt.deploy(args)
+	case "logs":
+		return clt.logs(args)
 	default:
 		return copr.CTLResponse{}, errors.Errorf("invalid subcommand %q", cmd)
 	}
@@ -160,3 +186,134 @@ func (clt *client) deploy(args []string) (copr.CTLResponse, error) {
 	}
 	return clt.post(fmt.Sprintf("deploy?unit=%s", args[0]), buf)
 }
+
+func (clt *client) restartAll(args []string) (copr.CTLResponse, error) {
+	usage := errors.Errorf("usage: restart-all [-parallel 1] [-pause 10s] [-wait-healthy] [-health-timeout 60s]")
+	fs := flag.NewFlagSet("restart-all", flag.ContinueOnError)
+	parallel := fs.Int("parallel", 1, "number of units restarted at once")
+	pause := fs.Duration("pause", 0, "pause between two batches")
+	waitHealthy := fs.Bool("wait-healthy", false, "wait for the restarted units to become healthy")
+	healthTimeout := fs.Duration("health-timeout", 60*time.Second, "time the restarted units have to become healthy")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return copr.CTLResponse{}, usage
+	}
+
+	q := url.Values{}
+	q.Set("parallel", strconv.Itoa(*parallel))
+	q.Set("pause", pause.String())
+	if *waitHealthy {
+		q.Set("wait-healthy", "true")
+	}
+	q.Set("health-timeout", healthTimeout.String())
+	// a rolling restart takes its time, but runs aside the command loop. So waiting for its report blocks no other command.
+	return clt.postTimeout(fmt.Sprintf("restart-all?%s", q.Encode()), nil, 24*time.Hour)
+}
+
+func (clt *client) remove(args []string) (copr.CTLResponse, error) {
+	usage := errors.Errorf("usage: remove <unit> [--keep-archive=false]")
+	fs := flag.NewFlagSet("remove", flag.ContinueOnError)
+	keepArchive := fs.Bool("keep-archive", true, "archive the unit dir before it is deleted")
+	var unit string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		unit, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return copr.CTLResponse{}, usage
+	}
+	if unit == "" {
+		unit = fs.Arg(0)
+	}
+	if unit == "" {
+		return copr.CTLResponse{}, usage
+	}
+
+	q := url.Values{}
+	q.Set("unit", unit)
+	q.Set("keep-archive", strconv.FormatBool(*keepArchive))
+	return clt.postTimeout(fmt.Sprintf("remove?%s", q.Encode()), nil, time.Minute)
+}
+
+func (clt *client) signal(args []string) (copr.CTLResponse, error) {
+	usage := errors.Errorf("usage: signal <unit> <SIG> [-group]")
+	fs := flag.NewFlagSet("signal", flag.ContinueOnError)
+	group := fs.Bool("group", false, "signal the process group of the unit")
+	var pos []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		pos, args = append(pos, args[0]), args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return copr.CTLResponse{}, usage
+	}
+	pos = append(pos, fs.Args()...)
+	if len(pos) != 2 {
+		return copr.CTLResponse{}, usage
+	}
+
+	q := url.Values{}
+	q.Set("unit", pos[0])
+	q.Set("sig", pos[1])
+	if *group {
+		q.Set("group", "true")
+	}
+	return clt.post(fmt.Sprintf("signal?%s", q.Encode()), nil)
+}
+
+func (clt *client) logs(args []string) (copr.CTLResponse, error) {
+	usage := errors.Errorf("usage: logs <unit> [-f] [-n 100] [--stderr]")
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "follow the log")
+	tail := fs.Int("n", 100, "number of lines")
+	stderr := fs.Bool("stderr", false, "show stderr instead of stdout")
+	var unit string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		unit, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return copr.CTLResponse{}, usage
+	}
+	if unit == "" {
+		unit = fs.Arg(0)
+	}
+	if unit == "" {
+		return copr.CTLResponse{}, usage
+	}
+
+	q := url.Values{}
+	q.Set("unit", unit)
+	q.Set("tail", strconv.Itoa(*tail))
+	if *follow {
+		q.Set("follow", "true")
+	}
+	if *stderr {
+		q.Set("stream", "stderr")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if !*follow {
+		var tcancel func()
+		ctx, tcancel = context.WithTimeout(ctx, 10*time.Second)
+		defer tcancel()
+	}
+	u := fmt.Sprintf("http://%s/logs?%s", clt.host, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return copr.CTLResponse{}, errors.Wrapf(err, "new-get-request to %q", u)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", clt.apiKey))
+	resp, err := clt.httpClient.Do(req)
+	if err != nil {
+		return copr.CTLResponse{}, errors.Wrapf(err, "get %q", u)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var ctlRes copr.CTLResponse
+		json.NewDecoder(resp.Body).Decode(&ctlRes)
+		return ctlRes, errors.Errorf("status %s", resp.Status)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	if err != nil && ctx.Err() == nil {
+		return copr.CTLResponse{}, errors.Wrap(err, "read logs")
+	}
+	return copr.CTLResponse{}, nil
+}
@@ -23,6 +23,9 @@ func run() error {
 	bind := flag.String("bind", ":21001", "http-bind-address")
 	dir := flag.String("dir", "../../_demo", "workspace directory")
 	sec := flag.String("sec", "sst", "copr secret password")
+	cgroupRoot := flag.String("cgroup-root", "", "delegated cgroup v2 directory for per-unit cgroups (disabled if empty)")
+	detached := flag.Bool("detached", false, "let units survive a restart of coprd and adopt them on start")
+	subreaper := flag.Bool("subreaper", true, "reap orphaned descendants of units and report them as strays")
 	flag.Parse()
 
 	secPath := filepath.Join(*dir, copr.SecretFile)
@@ -45,7 +48,17 @@ func run() error {
 		log.Infof("global-env: %q = %q", k, v)
 	}
 
-	controller, err := copr.NewController(*dir, secs, glbEnv)
+	var opts []copr.ControllerOption
+	if *cgroupRoot != "" {
+		opts = append(opts, copr.WithCgroupRoot(*cgroupRoot))
+	}
+	if *subreaper {
+		opts = append(opts, copr.WithSubreaper())
+	}
+	if *detached {
+		opts = append(opts, copr.WithDetachedProcesses())
+	}
+	controller, err := copr.NewController(*dir, secs, glbEnv, opts...)
 	if err != nil {
 		return errors.Wrapf(err, "new controller in %q", *dir)
 	}
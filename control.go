@@ -3,21 +3,86 @@ package copr
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mazzegi/log"
 	"github.com/pkg/errors"
 )
 
+// controllerUnit is an instance of a unit
 type controllerUnit struct {
-	unit   Unit
-	guard  *Guard
-	cancel func()
+	unit Unit
+	// instance is 0 for single instance units, and 1..n otherwise
+	instance int
+	// name is the unit name with the instance suffix, like "worker#2"
+	name     string
+	guard    *Guard
+	health   *healthMonitor
+	watchdog *watchdog
+	schedule *unitSchedule
+	logs     *unitLogs
+	cgroup   string
+	sockets  *unitSockets
+	// portOffset is added to the port of the instance. It alternates with overlapping deploys on alternate ports.
+	portOffset int
+	cancel     func()
+	// guardDoneC is closed, when the guard run by runGuard is done
+	guardDoneC chan struct{}
+	// stops counts the stops of the instance, so that a start, which waits for dependencies, gives up on a stop
+	stops int
 }
 
-func NewController(dir string, secs *Secrets, glbEnv map[string]string) (*Controller, error) {
+// expander returns the placeholder expander of the instance
+func (cu *controllerUnit) expander() instanceExpander {
+	ie := newInstanceExpander(cu.unit.Config, cu.instance)
+	if ie.port > 0 {
+		ie.port += cu.portOffset
+	}
+	return ie
+}
+
+type ControllerOption func(c *Controller) error
+
+// WithCgroupRoot enables cgroups for all units. Root must be a cgroup v2 directory delegated to coprd, which doesn't contain processes itself.
+func WithCgroupRoot(root string) ControllerOption {
+	return func(c *Controller) error {
+		if _, err := os.Stat(filepath.Join(root, "cgroup.procs")); err != nil {
+			return errors.Errorf("%q is not a cgroup v2 directory", root)
+		}
+		c.cgroupRoot = root
+		return nil
+	}
+}
+
+// WithDetachedProcesses lets unit processes survive a restart of coprd. Their PIDs are recorded in the workspace
+// and still running processes are adopted on the next start instead of starting them again.
+func WithDetachedProcesses() ControllerOption {
+	return func(c *Controller) error {
+		c.detached = true
+		return nil
+	}
+}
+
+// WithSubreaper makes coprd the child subreaper of its descendants. Orphans of units are reaped, when they exit,
+// and reported as strays of their unit as long as they run.
+func WithSubreaper() ControllerOption {
+	return func(c *Controller) error {
+		err := setChildSubreaper()
+		if err != nil {
+			return err
+		}
+		c.groups = newProcessGroups()
+		return nil
+	}
+}
+
+func NewController(dir string, secs *Secrets, glbEnv map[string]string, opts ...ControllerOption) (*Controller, error) {
 	us, err := LoadUnits(dir, secs)
 	if err != nil {
 		return nil, errors.Wrapf(err, "load-units in %q", dir)
@@ -29,41 +94,332 @@ func NewController(dir string, secs *Secrets, glbEnv map[string]string) (*Contro
 		commandC:    make(chan Command),
 		statCache:   NewUnitStatsCache(),
 	}
+	for _, o := range opts {
+		err := o(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.detached {
+		c.procState, err = loadProcessState(filepath.Join(us.dir, ProcessStateFile))
+		if err != nil {
+			return nil, errors.Wrap(err, "load process state")
+		}
+	}
 	for _, u := range us.units {
-		u := u
-		env := u.Config.Env
-		for k, v := range glbEnv {
-			env = append(env, fmt.Sprintf("%s=%s", k, v))
-		}
-
-		log.Debugf("controller: new-guard: prg=%q; args=%v; env=%v", u.Config.Program, u.Config.Args, env)
-		guard, err := NewGuard(
-			filepath.Join(u.Dir, u.Config.Program),
-			WithArgs(u.Config.Args...),
-			WithEnv(env...),
-			WithWd(u.Dir),
-			WithRestartAfter(time.Second*time.Duration(u.Config.RestartAfterSec)),
-			WithOnChange(func(rs GuardRunningState, pid int) {
-				switch rs {
-				case GuardStatusRunningStarted:
-					c.statCache.started(u.Name, pid)
-				case GuardStatusRunningStopped:
-					c.statCache.stopped(u.Name)
-				}
-			}),
-		)
+		for _, i := range instanceNumbers(u.Config) {
+			cu, err := c.newControllerUnit(u, i)
+			if err != nil {
+				return nil, err
+			}
+			c.units = append(c.units, cu)
+			c.registerUnit(cu)
+		}
+	}
+	_, broken := partialUnitOrder(c.distinctUnits())
+	for _, u := range us.units {
+		if err, ok := broken[u.Name]; ok {
+			log.Errorf("controller: unit %q can't be started: %v", u.Name, err)
+		}
+	}
+
+	return c, nil
+}
+
+// unitEnv returns the expanded unit env extended by the global env
+func (c *Controller) unitEnv(cu *controllerUnit) []string {
+	env := cu.expander().expandAll(cu.unit.Config.Env)
+	for k, v := range c.glbEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
+
+func (c *Controller) newControllerUnit(u Unit, instance int) (*controllerUnit, error) {
+	cu := &controllerUnit{
+		unit:     u,
+		instance: instance,
+		name:     instanceName(u.Name, instance),
+		watchdog: newWatchdog(u.Config.Watchdog),
+		schedule: newUnitSchedule(u.Config, time.Now()),
+		logs:     newUnitLogs(),
+	}
+	cu.health = c.healthMonitor(cu)
+	err := c.setupCgroup(cu)
+	if err != nil {
+		return nil, err
+	}
+	err = c.setupSockets(cu)
+	if err != nil {
+		return nil, err
+	}
+	c.openLogs(cu)
+	log.Debugf("controller: new-guard: prg=%q; args=%v", u.Config.Program, u.Config.Args)
+	guard, err := NewGuard(filepath.Join(u.Dir, u.Config.Program), c.guardOpts(cu)...)
+	if err != nil {
+		cu.logs.close()
+		cu.sockets.close()
+		return nil, errors.Wrapf(err, "new-guard for unit %q", cu.name)
+	}
+	cu.guard = guard
+	return cu, nil
+}
+
+// registerUnit adds the unit instance to the stats
+func (c *Controller) registerUnit(cu *controllerUnit) {
+	c.statCache.add(cu.name, cu.unit.Config.Enabled)
+	c.statCache.setInstance(cu.name, cu.unit.Name, cu.instance)
+	c.statCache.healthChanged(cu.name, cu.health)
+	c.statCache.setCgroup(cu.name, cu.cgroup)
+	c.statCache.setSchedule(cu.name, cu.schedule)
+	c.statCache.setSockets(cu.name, cu.sockets.addresses())
+}
+
+// runGuard runs the guard of cu until the controller or the unit is done
+func (c *Controller) runGuard(cu *controllerUnit) {
+	log.Infof("controller: run %q", cu.name)
+	c.wg.Add(1)
+	gctx, cancel := context.WithCancel(c.runCtx)
+	cu.cancel = cancel
+	doneC := make(chan struct{})
+	cu.guardDoneC = doneC
+	go func(g *Guard) {
+		defer c.wg.Done()
+		defer close(doneC)
+		g.RunCtx(gctx)
+	}(cu.guard)
+}
+
+// handOverGuard replaces the guard of cu by the one of ncu, which runGuard runs. The guard, its cancel func and
+// its done channel only change together. Callers hold c.Lock.
+func (c *Controller) handOverGuard(cu *controllerUnit, ncu *controllerUnit) {
+	cu.guard = ncu.guard
+	cu.cancel = ncu.cancel
+	cu.guardDoneC = ncu.guardDoneC
+}
+
+// removeControllerUnit removes a stopped unit instance
+func (c *Controller) removeControllerUnit(cu *controllerUnit) {
+	c.detachControllerUnit(cu)
+	c.releaseControllerUnit(cu)
+}
+
+// detachControllerUnit removes the stopped unit instance cu from the controller and waits until its guard is done
+func (c *Controller) detachControllerUnit(cu *controllerUnit) {
+	c.Lock()
+	for i, ocu := range c.units {
+		if ocu == cu {
+			c.units = append(c.units[:i], c.units[i+1:]...)
+			break
+		}
+	}
+	c.Unlock()
+	if cu.cancel != nil {
+		cu.cancel()
+		<-cu.guardDoneC
+	}
+}
+
+// reattachControllerUnit adds the detached unit instance cu again and runs its guard
+func (c *Controller) reattachControllerUnit(cu *controllerUnit) {
+	c.Lock()
+	c.units = append(c.units, cu)
+	c.runGuard(cu)
+	c.Unlock()
+}
+
+// releaseControllerUnit releases the logs, sockets, stats and cgroup of the detached unit instance cu
+func (c *Controller) releaseControllerUnit(cu *controllerUnit) {
+	cu.logs.drop()
+	cu.sockets.close()
+	c.statCache.remove(cu.name)
+	if cu.cgroup != "" {
+		if err := removeCgroup(cu.cgroup); err != nil {
+			log.Warnf("controller: %q: %v", cu.name, err)
+		}
+	}
+}
+
+// setupCgroup creates or updates the cgroup of the unit, if cgroups are enabled
+func (c *Controller) setupCgroup(cu *controllerUnit) error {
+	if c.cgroupRoot == "" {
+		return nil
+	}
+	var cc CgroupConfig
+	if cu.unit.Config.Cgroup != nil {
+		cc = *cu.unit.Config.Cgroup
+	}
+	path, err := setupCgroup(c.cgroupRoot, cu.name, cc)
+	if err != nil {
+		return errors.Wrapf(err, "setup cgroup for unit %q", cu.name)
+	}
+	cu.cgroup = path
+	return nil
+}
+
+// setupSockets opens the listen sockets of the unit. Sockets, which are already open for the same config, are kept open.
+func (c *Controller) setupSockets(cu *controllerUnit) error {
+	scs := cu.expander().expandSockets(cu.unit.Config.Sockets)
+	if cu.sockets.matches(scs) {
+		return nil
+	}
+	cu.sockets.close()
+	cu.sockets = nil
+	if len(scs) == 0 {
+		return nil
+	}
+	us, err := openSockets(cu.unit.Dir, scs)
+	if err != nil {
+		return errors.Wrapf(err, "open sockets of unit %q", cu.name)
+	}
+	cu.sockets = us
+	return nil
+}
+
+// openLogs (re-)opens the log files of the unit. If that fails, the unit logs to the console.
+func (c *Controller) openLogs(cu *controllerUnit) {
+	var lc LogConfig
+	if cu.unit.Config.Logs != nil {
+		lc = *cu.unit.Config.Logs
+	}
+	err := cu.logs.open(cu.unit.Dir, cu.instance, lc)
+	if err != nil {
+		log.Errorf("controller: unit %q: open logs: %v", cu.name, err)
+	}
+}
+
+// guardOpts returns the guard options derived from the unit config
+func (c *Controller) guardOpts(cu *controllerUnit) []GuardOption {
+	u := cu.unit
+	name := cu.name
+	ie := cu.expander()
+	var hooks Hooks
+	if u.Config.Hooks != nil {
+		hooks = u.Config.Hooks.hooks(ie)
+	}
+	opts := []GuardOption{
+		WithArgs(ie.expandAll(u.Config.Args)...),
+		WithEnv(c.unitEnv(cu)...),
+		WithWd(u.Dir),
+		WithStdOut(cu.logs.stdoutWriter()),
+		WithStdErr(cu.logs.stderrWriter()),
+		WithRestartAfter(time.Second * time.Duration(u.Config.RestartAfterSec)),
+		WithStopSignal(u.Config.stopSignal()),
+		WithKillTimeout(u.Config.stopTimeout()),
+		WithKillMode(u.Config.killMode()),
+		WithRLimits(u.Config.rlimits()...),
+		WithCgroup(cu.cgroup),
+		WithCredential(u.Credential),
+		WithHooks(hooks),
+		WithRestartMode(u.Config.restartMode()),
+		WithRestartPolicy(u.Config.restartPolicy()),
+		WithOnChange(func(rs GuardRunningState, pid int) {
+			c.guardChanged(name, rs, pid)
+		}),
+		WithOnDesiredChange(func(d DesiredState) {
+			c.statCache.desiredChanged(name, d)
+		}),
+		WithOnExit(func(ei ExitInfo) {
+			c.statCache.exited(name, ei)
+			if u.Config.Schedule != "" {
+				c.statCache.scheduleResult(name, scheduleResult(ei))
+			}
+		}),
+	}
+	opts = append(opts, c.startupOpts(cu)...)
+	if cu.sockets != nil {
+		opts = append(opts, WithListenFiles(cu.sockets.files, cu.sockets.names()))
+	} else {
+		opts = append(opts, WithListenFiles(nil, nil))
+	}
+	if c.detached {
+		dir := filepath.Join(u.Dir, logsDir)
+		opts = append(opts, WithDetached(
+			filepath.Join(dir, outputFileName("stdout", cu.instance)),
+			filepath.Join(dir, outputFileName("stderr", cu.instance)),
+		))
+	}
+	return opts
+}
+
+// guardChanged updates the stats and the process records, when the state of the guard of an instance changed
+func (c *Controller) guardChanged(name string, rs GuardRunningState, pid int) {
+	c.statCache.changed(name, rs, pid)
+	c.recordProcess(name, rs, pid)
+	if c.groups != nil && rs == GuardStatusRunningStarted {
+		// unit processes are started with setpgid, so the pgid equals the pid
+		c.groups.add(pid, name)
+	}
+}
+
+// recordProcess updates the process state of a detached unit instance
+func (c *Controller) recordProcess(name string, rs GuardRunningState, pid int) {
+	if c.procState == nil {
+		return
+	}
+	var err error
+	switch rs {
+	case GuardStatusRunningStarted:
+		var id ProcessIdentity
+		id, err = readProcessIdentity(pid)
 		if err != nil {
-			return nil, errors.Wrapf(err, "new-guard for unit %q", u.Name)
+			break
+		}
+		if rec, ok := c.procState.record(name); ok && rec.PID == id.PID && rec.StartTime == id.StartTime {
+			// adopted
+			return
 		}
+		id.StartedAt = time.Now().UTC()
+		err = c.procState.set(name, id)
+	case GuardStatusNotRunning:
+		// the guard is done, but a detached process keeps running
+		return
+	default:
+		err = c.procState.remove(name)
+	}
+	if err != nil {
+		log.Warnf("controller: record process of %q: %v", name, err)
+	}
+}
 
-		c.units = append(c.units, &controllerUnit{
-			unit:  u,
-			guard: guard,
-		})
-		c.statCache.add(u.Name, u.Config.Enabled)
+// adoptProcesses adopts the recorded processes of the last run of coprd, which are still running
+func (c *Controller) adoptProcesses() {
+	if c.procState == nil {
+		return
 	}
+	c.RLock()
+	defer c.RUnlock()
+	for _, name := range c.procState.names() {
+		id, _ := c.procState.record(name)
+		var cu *controllerUnit
+		for _, ocu := range c.units {
+			if ocu.name == name {
+				cu = ocu
+				break
+			}
+		}
+		if cu == nil {
+			log.Warnf("controller: recorded process of %q (%s) belongs to no unit anymore", name, id)
+			c.procState.remove(name)
+			continue
+		}
+		err := cu.guard.Adopt(id)
+		if err != nil {
+			log.Infof("controller: not adopting %q: %v", name, err)
+			c.procState.remove(name)
+			continue
+		}
+		log.Infof("controller: adopted %q with PID %d", name, id.PID)
+	}
+}
 
-	return c, nil
+// healthMonitor returns a health monitor for the unit instance or nil, if the unit has no health check
+func (c *Controller) healthMonitor(cu *controllerUnit) *healthMonitor {
+	if cu.unit.Config.Health == nil {
+		return nil
+	}
+	hc := cu.expander().expandHealth(*cu.unit.Config.Health)
+	return newHealthMonitor(hc, cu.unit.Dir, c.unitEnv(cu), cu.unit.Credential)
 }
 
 type Controller struct {
@@ -71,29 +427,32 @@ type Controller struct {
 	unitConfigs *Units
 	glbEnv      map[string]string
 	units       []*controllerUnit
+	cgroupRoot  string
+	detached    bool
+	procState   *processState
+	groups      *processGroups
 	commandC    chan Command
 	statCache   *UnitStatsCache
+	// runCtx and wg are set up by RunCtx for the guards and background loops
+	runCtx context.Context
+	wg     sync.WaitGroup
+	// opMx serializes deploys, removals and rolling restarts. It is only tried, so that the command loop never waits for it.
+	opMx sync.Mutex
 }
 
 func (c *Controller) RunCtx(ctx context.Context) {
 	log.Infof("controller: run")
 	c.Lock()
-	wg := sync.WaitGroup{}
+	c.runCtx = ctx
 	for _, cu := range c.units {
-		log.Infof("controller: run %q", cu.unit.Name)
-		wg.Add(1)
-		gctx, cancel := context.WithCancel(ctx)
-		cu.cancel = cancel
-		go func(g *Guard) {
-			defer wg.Done()
-			g.RunCtx(gctx)
-		}(cu.guard)
+		c.runGuard(cu)
 	}
 	c.Unlock()
+	c.adoptProcesses()
 
-	wg.Add(1)
+	c.wg.Add(1)
 	go func() {
-		defer wg.Done()
+		defer c.wg.Done()
 		timer := time.NewTimer(5 * time.Second)
 		for {
 			select {
@@ -101,15 +460,43 @@ func (c *Controller) RunCtx(ctx context.Context) {
 				return
 			case <-timer.C:
 				c.statCache.collect()
+				c.checkWatchdogs()
+				c.refreshProcessState()
 				timer.Reset(5 * time.Second)
 			}
 		}
 	}()
 
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.runHealthChecks(ctx)
+	}()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.runSchedules(ctx)
+	}()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.runSocketActivation(ctx)
+	}()
+
+	if c.groups != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.runReaper(ctx)
+		}()
+	}
+
 	allDoneC := make(chan struct{})
 	go func() {
 		defer close(allDoneC)
-		wg.Wait()
+		c.wg.Wait()
 	}()
 	log.Infof("controller: loop")
 
@@ -122,58 +509,249 @@ loop:
 			switch cmd := cmd.(type) {
 			case *CommandStartAll:
 				log.Debugf("start-all-command")
-				cmd.resultC <- c.startAll()
+				// starts may wait for dependencies, so they run aside the command loop
+				c.runAside(cmd.resultC, func() CommandResponse { return c.startAll(ctx) })
 			case *CommandStopAll:
 				cmd.resultC <- c.stopAll()
 			case *CommandStart:
-				cmd.resultC <- c.start(cmd.unit)
+				unit := cmd.unit
+				c.runAside(cmd.resultC, func() CommandResponse { return c.start(ctx, unit) })
 			case *CommandStop:
 				cmd.resultC <- c.stop(cmd.unit)
 			case *CommandEnable:
 				cmd.resultC <- c.enable(cmd.unit)
 			case *CommandDisable:
 				cmd.resultC <- c.disable(cmd.unit)
-			case *CommandDeploy:
+			case *CommandRestart:
+				unit := cmd.unit
+				c.runAside(cmd.resultC, func() CommandResponse { return c.restart(ctx, unit) })
+			case *CommandRestartAll:
 				var resp CommandResponse
-				cu, ok := c.findUnit(cmd.unit)
-				if ok {
-					resp = c.deployUpdate(cu, cmd.dir)
+				if !c.tryOperation("rolling restart", &resp) {
 					cmd.resultC <- resp
 					continue loop
 				}
-				cu, resp = c.deployCreate(cmd.unit, cmd.dir)
-				if !resp.HasErrors() {
-					log.Infof("controller: run %q", cu.unit.Name)
-					wg.Add(1)
-					gctx, cancel := context.WithCancel(ctx)
-					cu.cancel = cancel
-					go func(g *Guard) {
-						defer wg.Done()
-						g.RunCtx(gctx)
-					}(cu.guard)
-					sresp := c.start(cmd.unit)
-					resp.merge(sresp)
+				// a rolling restart takes long, so it runs aside the command loop
+				c.wg.Add(1)
+				go func(cmd *CommandRestartAll) {
+					defer c.wg.Done()
+					defer c.opMx.Unlock()
+					cmd.resultC <- c.restartAll(ctx, cmd.opts)
+				}(cmd)
+			case *CommandReload:
+				cmd.resultC <- c.reload(cmd.unit)
+			case *CommandRemove:
+				cmd.resultC <- c.remove(cmd.unit, cmd.keepArchive)
+			case *CommandSignal:
+				cmd.resultC <- c.signal(cmd.unit, cmd.sig, cmd.group)
+			case *CommandDeploy:
+				resp, created := c.deploy(cmd.unit, cmd.dir)
+				if !created {
+					cmd.resultC <- resp
+					continue loop
 				}
-				cmd.resultC <- resp
+				unit := cmd.unit
+				c.runAside(cmd.resultC, func() CommandResponse {
+					resp.merge(c.start(ctx, unit))
+					return resp
+				})
 			default:
 				log.Warnf("invalid command of type %T", cmd)
 			}
 		}
 	}
 
+	c.refreshProcessState()
 	select {
 	case <-time.After(5 * time.Second):
 		log.Warnf("controller: timeout in wait for all guards done")
-		return
 	case <-allDoneC:
 		log.Infof("controller: all guards are done")
+	}
+	c.Lock()
+	for _, cu := range c.units {
+		cu.logs.drop()
+		cu.sockets.close()
+	}
+	c.Unlock()
+}
+
+// refreshProcessState drops the records of detached processes, which are gone
+func (c *Controller) refreshProcessState() {
+	if c.procState == nil {
 		return
 	}
+	if err := c.procState.refresh(); err != nil {
+		log.Warnf("controller: refresh process state: %v", err)
+	}
 }
 
-func (c *Controller) startAll() (resp CommandResponse) {
+// runReaper reaps orphans, when a child exits, and updates the strays of the units periodically
+func (c *Controller) runReaper(ctx context.Context) {
+	chldC := make(chan os.Signal, 1)
+	signal.Notify(chldC, syscall.SIGCHLD)
+	defer signal.Stop(chldC)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-chldC:
+		case <-ticker.C:
+		}
+		c.reapOrphans()
+	}
+}
+
+// reapOrphans reaps exited orphans and attributes them and the running strays to units by their process group
+func (c *Controller) reapOrphans() {
+	reaped, strays, err := reapOrphans()
+	if err != nil {
+		log.Warnf("controller: reap orphans: %v", err)
+		return
+	}
+	for _, ro := range reaped {
+		name, ok := c.groups.unit(ro.PGID)
+		if !ok {
+			log.Infof("controller: reaped orphan (%s) of no unit: %s", ro.StrayProcess, ro.status)
+			continue
+		}
+		log.Infof("controller: reaped orphan (%s) of unit %q: %s", ro.StrayProcess, name, ro.status)
+		c.statCache.orphanReaped(name)
+	}
+
+	unitStrays := map[string][]StrayProcess{}
+	strayGroups := map[int]bool{}
+	for _, sp := range strays {
+		strayGroups[sp.PGID] = true
+		name, ok := c.groups.unit(sp.PGID)
+		if !ok {
+			log.Debugf("controller: stray process (%s) of no unit", sp)
+			continue
+		}
+		unitStrays[name] = append(unitStrays[name], sp)
+	}
+	mainGroups := map[int]bool{}
+	c.RLock()
+	for _, cu := range c.units {
+		if pid := cu.guard.PID(); pid > 0 {
+			mainGroups[pid] = true
+		}
+		c.statCache.setStrays(cu.name, unitStrays[cu.name])
+	}
+	c.RUnlock()
+	c.groups.prune(func(pgid int) bool {
+		return mainGroups[pgid] || strayGroups[pgid]
+	})
+}
+
+// runHealthChecks runs the health checks of all started units, which are due
+func (c *Controller) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.RLock()
+		for _, cu := range c.units {
+			if cu.health == nil {
+				continue
+			}
+			st := cu.guard.Status()
+			if st.RunningState != GuardStatusRunningStarted {
+				if status, _, _, _ := cu.health.state(); status != HealthUnknown {
+					cu.health.reset()
+					c.statCache.healthChanged(cu.name, cu.health)
+				}
+				continue
+			}
+			if !cu.health.claim(st.StartedAt) {
+				continue
+			}
+			go c.checkHealth(ctx, cu.name, cu.guard, cu.health)
+		}
+		c.RUnlock()
+	}
+}
+
+func (c *Controller) checkHealth(ctx context.Context, unit string, guard *Guard, m *healthMonitor) {
+	becameUnhealthy := m.check(ctx)
+	c.statCache.healthChanged(unit, m)
+	if !becameUnhealthy {
+		return
+	}
+	_, failures, _, err := m.state()
+	log.Warnf("controller: unit %q is unhealthy after %d failed checks: %v", unit, failures, err)
+	if !m.cfg.RestartOnUnhealthy {
+		return
+	}
+	pid, _, err := guard.AutoRestartReport()
+	if err == ErrRestartSkipped {
+		log.Infof("controller: not restarting unhealthy unit %q, as it is stopped", unit)
+		return
+	}
+	if err != nil {
+		log.Errorf("controller: restart unhealthy unit %q: %v", unit, err)
+		return
+	}
+	m.reset()
+	c.statCache.healthChanged(unit, m)
+	log.Infof("controller: restarted unhealthy unit %q with PID %d", unit, pid)
+}
+
+// checkWatchdogs evaluates the watchdog rules of all units against the recent stats
+func (c *Controller) checkWatchdogs() {
+	now := time.Now()
+	c.RLock()
+	defer c.RUnlock()
 	for _, cu := range c.units {
-		uresp := c.start(cu.unit.Name)
+		if len(cu.watchdog.rules) == 0 {
+			continue
+		}
+		sd, err := c.statCache.statsDescriptor(cu.name)
+		if err != nil {
+			continue
+		}
+		for _, ev := range cu.watchdog.check(sd, now) {
+			log.Warnf("controller: watchdog of unit %q triggered: %s", cu.name, ev)
+			if ev.Action != WatchdogRestart {
+				c.statCache.watchdogEvent(cu.name, ev)
+				continue
+			}
+			go c.watchdogRestart(cu.name, cu.guard, ev)
+		}
+	}
+}
+
+func (c *Controller) watchdogRestart(unit string, guard *Guard, ev WatchdogEvent) {
+	pid, _, err := guard.AutoRestartReport()
+	if err != nil {
+		ev.Error = err.Error()
+		log.Errorf("controller: watchdog restart of unit %q: %v", unit, err)
+	} else {
+		log.Infof("controller: watchdog restarted unit %q with PID %d", unit, pid)
+	}
+	c.statCache.watchdogEvent(unit, ev)
+}
+
+func (c *Controller) startAll(ctx context.Context) (resp CommandResponse) {
+	c.RLock()
+	cus := c.orderedUnits()
+	c.RUnlock()
+	for _, cu := range cus {
+		if cu.unit.Config.Schedule != "" {
+			resp.AddMsg("unit %q is started by its schedule %q", cu.name, cu.unit.Config.Schedule)
+			continue
+		}
+		if cu.unit.Config.LazyStart {
+			resp.AddMsg("unit %q is started on the first connection", cu.name)
+			continue
+		}
+		uresp := c.start(ctx, cu.name)
 		resp.merge(uresp)
 	}
 	//resp.log()
@@ -181,73 +759,374 @@ func (c *Controller) startAll() (resp CommandResponse) {
 }
 
 func (c *Controller) stopAll() (resp CommandResponse) {
-	for _, cu := range c.units {
-		uresp := c.stop(cu.unit.Name)
+	cus := c.orderedUnits()
+	for i := len(cus) - 1; i >= 0; i-- {
+		uresp := c.stop(cus[i].name)
 		resp.merge(uresp)
 	}
 	//resp.log()
 	return
 }
 
-func (c *Controller) findUnit(unit string) (*controllerUnit, bool) {
+// findUnits returns all instances of a unit, or the single instance for a name like "unit#2"
+func (c *Controller) findUnits(unit string) []*controllerUnit {
+	var cus []*controllerUnit
+	for _, cu := range c.units {
+		if cu.name == unit || cu.unit.Name == unit {
+			cus = append(cus, cu)
+		}
+	}
+	return cus
+}
+
+// unitInstances returns the instances of the unit with name unit
+func (c *Controller) unitInstances(unit string) []*controllerUnit {
+	var cus []*controllerUnit
 	for _, cu := range c.units {
 		if cu.unit.Name == unit {
-			return cu, true
+			cus = append(cus, cu)
 		}
 	}
-	return nil, false
+	return cus
 }
 
+// findUnit returns the unit instance, which is unambiguously identified by unit
+func (c *Controller) findUnit(unit string) (*controllerUnit, error) {
+	cus := c.findUnits(unit)
+	switch len(cus) {
+	case 0:
+		return nil, errors.Errorf("no such unit %q", unit)
+	case 1:
+		return cus[0], nil
+	default:
+		return nil, errors.Errorf("unit %q has %d instances, select one like %q", unit, len(cus), instanceName(unit, 1))
+	}
+}
+
+// runAside runs the command do aside the command loop and sends its response to resultC
+func (c *Controller) runAside(resultC chan CommandResponse, do func() CommandResponse) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		resultC <- do()
+	}()
+}
+
+// cancelStarts makes starts of cu, which wait for dependencies, give up
+func (c *Controller) cancelStarts(cu *controllerUnit) {
+	c.Lock()
+	cu.stops++
+	c.Unlock()
+}
+
+// unitDo calls do for all instances matching unit
 func (c *Controller) unitDo(unit string, do func(cu *controllerUnit, resp *CommandResponse)) (resp CommandResponse) {
-	if cu, ok := c.findUnit(unit); ok {
+	c.RLock()
+	cus := c.findUnits(unit)
+	c.RUnlock()
+	if len(cus) == 0 {
+		resp.Errorf("no such unit %q", unit)
+	}
+	for _, cu := range cus {
 		do(cu, &resp)
-		resp.log()
-		return
 	}
-	resp.Errorf("no such unit %q", unit)
 	resp.log()
 	return
 }
 
-func (c *Controller) start(unit string) (resp CommandResponse) {
+func (c *Controller) start(ctx context.Context, unit string) (resp CommandResponse) {
 	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
 		if !cu.unit.Config.Enabled {
-			resp.AddMsg("unit %q is disabled", unit)
+			resp.AddMsg("unit %q is disabled", cu.name)
 			return
 		}
 		if cu.guard.IsStarted() {
-			resp.AddMsg("guard %q is already started with PID %d", cu.unit.Name, cu.guard.PID())
+			resp.AddMsg("guard %q is already started with PID %d", cu.name, cu.guard.PID())
 			return
 		}
+		if err := c.waitDependencies(ctx, cu); err != nil {
+			resp.Errorf("not starting unit %q: %v", cu.name, err)
+			return
+		}
+		if cu.guard.IsCrashLooping() {
+			resp.AddMsg("reset crash-loop of %q", cu.name)
+		}
 
-		pid, err := cu.guard.Start()
+		pid, notes, err := cu.guard.StartReport()
+		for _, note := range notes {
+			resp.AddMsg("%s: %s", cu.name, note)
+		}
 		if err != nil {
-			resp.Errorf("starting unit %q: %v", unit, err)
+			resp.Errorf("starting unit %q: %v", cu.name, err)
 			return
 		}
 		//c.statCache.started(cu.unit.Name, pid)
-		resp.AddMsg("started %q with PID %d", cu.unit.Name, pid)
+		resp.AddMsg("started %q with PID %d", cu.name, pid)
 	})
 }
 
 func (c *Controller) stop(unit string) (resp CommandResponse) {
 	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
-		if !cu.guard.IsStarted() {
-			resp.AddMsg("guard %q is not started", cu.unit.Name)
+		c.cancelStarts(cu)
+		if !cu.guard.IsActive() {
+			if cu.unit.Config.LazyStart && !cu.guard.Status().StopRequested {
+				// record the stop, so that connections don't activate the unit anymore
+				cu.guard.Stop()
+				resp.AddMsg("unit %q won't be activated on connections anymore", cu.name)
+				return
+			}
+			resp.AddMsg("guard %q is not started", cu.name)
 			return
 		}
 
-		err := cu.guard.Stop()
+		notes, err := cu.guard.StopReport()
+		for _, note := range notes {
+			resp.AddMsg("%s: %s", cu.name, note)
+		}
 		if err != nil {
-			resp.Errorf("ERROR: stopping %q with PID %d: %v", cu.unit.Name, cu.guard.PID(), err)
+			resp.Errorf("ERROR: stopping %q with PID %d: %v", cu.name, cu.guard.PID(), err)
 			return
 		}
 		//c.statCache.stopped(cu.unit.Name)
-		resp.AddMsg("stopped %q", cu.unit.Name)
+		resp.AddMsg("stopped %q", cu.name)
+	})
+}
+
+func (c *Controller) restart(ctx context.Context, unit string) (resp CommandResponse) {
+	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
+		c.restartUnit(ctx, cu, false, resp)
+	})
+}
+
+// restartUnit stops the instance cu, if it is started, and starts it again. An auto restart doesn't override a stop,
+// which happened in the meantime.
+func (c *Controller) restartUnit(ctx context.Context, cu *controllerUnit, auto bool, resp *CommandResponse) {
+	if !cu.unit.Config.Enabled {
+		resp.AddMsg("unit %q is disabled", cu.name)
+		return
+	}
+	if err := c.waitDependencies(ctx, cu); err != nil {
+		resp.Errorf("not restarting unit %q: %v", cu.name, err)
+		return
+	}
+	restart := cu.guard.RestartReport
+	if auto {
+		restart = cu.guard.AutoRestartReport
+	}
+	pid, notes, err := restart()
+	for _, note := range notes {
+		resp.AddMsg("%s: %s", cu.name, note)
+	}
+	if err == ErrRestartSkipped {
+		resp.AddMsg("not restarting %q, as it was stopped", cu.name)
+		return
+	}
+	if err != nil {
+		resp.Errorf("restarting unit %q: %v", cu.name, err)
+		return
+	}
+	resp.AddMsg("restarted %q with PID %d", cu.name, pid)
+}
+
+// tryOperation acquires opMx for the operation op. If another operation holds it, an error is added to resp.
+func (c *Controller) tryOperation(op string, resp *CommandResponse) bool {
+	if !c.opMx.TryLock() {
+		resp.Errorf("%s refused: another deploy, remove or rolling restart is in progress", op)
+		return false
+	}
+	return true
+}
+
+// restartAll restarts the started units in dependency order in batches of opts.Parallel units. It runs aside the
+// command loop, with opMx held by the caller. A canceled ctx aborts it before the next batch.
+func (c *Controller) restartAll(ctx context.Context, opts RestartAllOptions) (resp CommandResponse) {
+	c.RLock()
+	cus := c.orderedUnits()
+	c.RUnlock()
+	var started []*controllerUnit
+	for _, cu := range cus {
+		if cu.guard.IsStarted() {
+			started = append(started, cu)
+		}
+	}
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	for i := 0; i < len(started); i += parallel {
+		if i > 0 && opts.Pause > 0 {
+			resp.AddMsg("pause for %s", opts.Pause)
+			select {
+			case <-ctx.Done():
+			case <-time.After(opts.Pause):
+			}
+		}
+		if ctx.Err() != nil {
+			resp.Errorf("rolling restart canceled after %d of %d units", i, len(started))
+			break
+		}
+		end := i + parallel
+		if end > len(started) {
+			end = len(started)
+		}
+		batch := started[i:end]
+		resps := make([]CommandResponse, len(batch))
+		var wg sync.WaitGroup
+		for j, cu := range batch {
+			wg.Add(1)
+			go func(cu *controllerUnit, resp *CommandResponse) {
+				defer wg.Done()
+				c.restartUnit(ctx, cu, true, resp)
+			}(cu, &resps[j])
+		}
+		wg.Wait()
+		for _, bresp := range resps {
+			resp.merge(bresp)
+		}
+		if resp.HasErrors() {
+			resp.Errorf("rolling restart aborted after %d of %d units", end, len(started))
+			break
+		}
+		if !opts.WaitHealthy {
+			continue
+		}
+		var checked []*controllerUnit
+		for _, cu := range batch {
+			if cu.health != nil {
+				checked = append(checked, cu)
+			}
+		}
+		if err := c.waitHealthy(checked, opts.HealthTimeout); err != nil {
+			resp.Errorf("rolling restart aborted after %d of %d units: %v", end, len(started), err)
+			break
+		}
+	}
+	resp.log()
+	return
+}
+
+// remove stops all instances of unit, removes them from the controller and deletes the unit dir
+func (c *Controller) remove(unit string, keepArchive bool) (resp CommandResponse) {
+	defer resp.log()
+	if strings.Contains(unit, instanceSep) {
+		resp.Errorf("remove applies to all instances of a unit, not to %q", unit)
+		return
+	}
+	if !c.tryOperation(fmt.Sprintf("remove of %q", unit), &resp) {
+		return
+	}
+	defer c.opMx.Unlock()
+	c.RLock()
+	cus := c.unitInstances(unit)
+	dependents := c.dependents(unit)
+	c.RUnlock()
+	if len(cus) == 0 {
+		resp.Errorf("no such unit %q", unit)
+		return
+	}
+	if len(dependents) > 0 {
+		resp.Errorf("unit %q is required by %s", unit, strings.Join(dependents, ", "))
+		return
+	}
+
+	for _, cu := range cus {
+		c.cancelStarts(cu)
+		if !cu.guard.IsActive() {
+			continue
+		}
+		notes, err := cu.guard.StopReport()
+		for _, note := range notes {
+			resp.AddMsg("%s: %s", cu.name, note)
+		}
+		if err != nil {
+			resp.Errorf("stopping %q with PID %d: %v", cu.name, cu.guard.PID(), err)
+			return
+		}
+		resp.AddMsg("stopped %q", cu.name)
+	}
+	// the guards must be done before the unit dir is deleted
+	for _, cu := range cus {
+		c.detachControllerUnit(cu)
+	}
+	archive, err := c.unitConfigs.Remove(unit, keepArchive)
+	if err != nil {
+		for _, cu := range cus {
+			c.reattachControllerUnit(cu)
+		}
+		resp.Errorf("remove unit %q: %v", unit, err)
+		resp.AddMsg("kept unit %q", unit)
+		return
+	}
+	for _, cu := range cus {
+		c.releaseControllerUnit(cu)
+	}
+	if archive != "" {
+		resp.AddMsg("removed unit %q, archived to %q", unit, archive)
+	} else {
+		resp.AddMsg("removed unit %q", unit)
+	}
+	return
+}
+
+// defaultAllowedSignals are the signals, which can be sent to units on request, unless a unit configures its own.
+// Signals which stop or kill a unit are left to the stop command, so the guard knows about it.
+var defaultAllowedSignals = []syscall.Signal{
+	syscall.SIGHUP,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+func (c *Controller) signal(unit string, sig syscall.Signal, group bool) (resp CommandResponse) {
+	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
+		if !cu.unit.Config.signalAllowed(sig) {
+			resp.Errorf("signal %s is not allowed for %q", signalName(sig), cu.name)
+			return
+		}
+		if !cu.guard.IsStarted() {
+			resp.Errorf("guard %q is not started", cu.name)
+			return
+		}
+		var pid int
+		var err error
+		if group {
+			pid, err = cu.guard.SignalGroup(sig)
+		} else {
+			pid, err = cu.guard.Signal(sig)
+		}
+		if err != nil {
+			resp.Errorf("signal %q: %v", cu.name, err)
+			return
+		}
+		if group {
+			resp.AddMsg("sent %s to process group of %q (PGID %d)", signalName(sig), cu.name, pid)
+		} else {
+			resp.AddMsg("sent %s to %q with PID %d", signalName(sig), cu.name, pid)
+		}
+	})
+}
+
+func (c *Controller) reload(unit string) (resp CommandResponse) {
+	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
+		if !cu.guard.IsStarted() {
+			resp.AddMsg("guard %q is not started", cu.name)
+			return
+		}
+		sig := cu.unit.Config.reloadSignal()
+		pid, err := cu.guard.Signal(sig)
+		if err != nil {
+			resp.Errorf("reloading %q: %v", cu.name, err)
+			return
+		}
+		resp.AddMsg("sent %s to %q with PID %d", signalName(sig), cu.name, pid)
 	})
 }
 
 func (c *Controller) enable(unit string) (resp CommandResponse) {
+	if strings.Contains(unit, instanceSep) {
+		resp.Errorf("enable applies to all instances of a unit, not to %q", unit)
+		return
+	}
 	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
 		if cu.unit.Config.Enabled {
 			resp.AddMsg("unit %q is already enabled", unit)
@@ -259,25 +1138,32 @@ func (c *Controller) enable(unit string) (resp CommandResponse) {
 			resp.Errorf("enable unit %q: save: %v", unit, err)
 			return
 		}
-		c.statCache.enabled(cu.unit.Name)
+		c.statCache.enabled(cu.name)
 		resp.AddMsg("enable unit %q", unit)
 	})
 }
 
 func (c *Controller) disable(unit string) (resp CommandResponse) {
+	if strings.Contains(unit, instanceSep) {
+		resp.Errorf("disable applies to all instances of a unit, not to %q", unit)
+		return
+	}
 	return c.unitDo(unit, func(cu *controllerUnit, resp *CommandResponse) {
 		if !cu.unit.Config.Enabled {
 			resp.AddMsg("unit %q is already disabled", unit)
 			return
 		}
-		if cu.guard.IsStarted() {
-			err := cu.guard.Stop()
+		if cu.guard.IsActive() {
+			notes, err := cu.guard.StopReport()
+			for _, note := range notes {
+				resp.AddMsg("%s: %s", cu.name, note)
+			}
 			if err != nil {
-				resp.Errorf("ERROR: stopping %q with PID %d: %v", cu.unit.Name, cu.guard.PID(), err)
+				resp.Errorf("ERROR: stopping %q with PID %d: %v", cu.name, cu.guard.PID(), err)
 				return
 			}
 			//c.statCache.stopped(cu.unit.Name)
-			resp.AddMsg("stopped %q", cu.unit.Name)
+			resp.AddMsg("stopped %q", cu.name)
 		}
 
 		cu.unit.Config.Enabled = false
@@ -286,100 +1172,187 @@ func (c *Controller) disable(unit string) (resp CommandResponse) {
 			resp.Errorf("disable unit %q: save: %v", unit, err)
 			return
 		}
-		c.statCache.disabled(cu.unit.Name)
+		c.statCache.disabled(cu.name)
 		resp.AddMsg("disable unit %q", unit)
 	})
 }
 
-func (c *Controller) deployCreate(unit string, dir string) (newUnit *controllerUnit, resp CommandResponse) {
+// deploy updates the instances of unit from dir, or creates them, if unit is new. Created units are left to the
+// caller to start.
+func (c *Controller) deploy(unit string, dir string) (resp CommandResponse, created bool) {
+	if !c.tryOperation(fmt.Sprintf("deploy of %q", unit), &resp) {
+		return
+	}
+	defer c.opMx.Unlock()
+	if cus := c.unitInstances(unit); len(cus) > 0 {
+		return c.deployUpdate(unit, cus, dir), false
+	}
+	resp = c.deployCreate(unit, dir)
+	return resp, !resp.HasErrors()
+}
+
+func (c *Controller) deployCreate(unit string, dir string) (resp CommandResponse) {
+	if strings.Contains(unit, instanceSep) {
+		resp.Errorf("invalid unit name %q: must not contain %q", unit, instanceSep)
+		return resp
+	}
+	uc, err := ReadUnitConfig(dir)
+	if err != nil {
+		resp.AddError(errors.Wrapf(err, "read unit-config %q in %q", unit, dir))
+		return resp
+	}
+	err = c.checkDependencies(Unit{Name: unit, Config: uc})
+	if err != nil {
+		resp.AddError(errors.Wrapf(err, "unit %q: dependencies", unit))
+		return resp
+	}
 	u, err := c.unitConfigs.Create(unit, dir)
 	if err != nil {
 		resp.AddError(errors.Wrapf(err, "create unit-config %q in %q", unit, dir))
-		return nil, resp
+		return resp
 	}
 	resp.AddMsg("unit %q: created", unit)
 
-	env := u.Config.Env
-	for k, v := range c.glbEnv {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	for _, i := range instanceNumbers(u.Config) {
+		cu, err := c.newControllerUnit(u, i)
+		if err != nil {
+			resp.AddError(err)
+			return resp
+		}
+		c.Lock()
+		c.units = append(c.units, cu)
+		c.runGuard(cu)
+		c.Unlock()
+		c.registerUnit(cu)
 	}
+	return resp
+}
 
-	guard, err := NewGuard(
-		filepath.Join(u.Dir, u.Config.Program),
-		WithArgs(u.Config.Args...),
-		WithEnv(env...),
-		WithWd(u.Dir),
-		WithRestartAfter(time.Second*time.Duration(u.Config.RestartAfterSec)),
-	)
+// deployUpdate updates all instances of unit and adds or removes instances, if their number changed
+func (c *Controller) deployUpdate(unit string, cus []*controllerUnit, dir string) (resp CommandResponse) {
+	uc, err := ReadUnitConfig(dir)
 	if err != nil {
-		resp.AddError(errors.Wrapf(err, "new-guard for unit %q", u.Name))
-		return nil, resp
+		resp.AddError(errors.Wrapf(err, "%q: read unit-config in %q", unit, dir))
+		return resp
+	}
+	err = c.checkDependencies(Unit{Name: unit, Config: uc})
+	if err != nil {
+		resp.AddError(errors.Wrapf(err, "%q: dependencies", unit))
+		return resp
 	}
 
-	newUnit = &controllerUnit{
-		unit:  u,
-		guard: guard,
+	reason := overlapBlocker(cus, uc)
+	if reason == "" {
+		return c.deployOverlap(unit, cus, dir, uc)
+	}
+	if uc.deployStrategy() == DeployOverlap {
+		resp.AddMsg("unit %q: deploying with restart, as %s", unit, reason)
 	}
-	c.units = append(c.units, newUnit)
-	c.statCache.add(u.Name, u.Config.Enabled)
-	return newUnit, resp
-}
 
-func (c *Controller) deployUpdate(cu *controllerUnit, dir string) (resp CommandResponse) {
 	wasRunning := false
-	if cu.guard.IsStarted() {
-		wasRunning = true
-		cu.guard.Stop()
+	for _, cu := range cus {
+		c.cancelStarts(cu)
+		if cu.guard.IsActive() {
+			wasRunning = true
+			cu.guard.Stop()
+		}
 	}
 
 	//
-	u, err := c.unitConfigs.Update(cu.unit.Name, dir)
+	u, err := c.unitConfigs.Update(unit, dir)
 	if err != nil {
-		resp.AddError(errors.Wrapf(err, "%q: update-unit-config", cu.unit.Name))
+		resp.AddError(errors.Wrapf(err, "%q: update-unit-config", unit))
 		return resp
 	}
-	cu.unit = u
-
-	//update guard
-	env := u.Config.Env
-	for k, v := range c.glbEnv {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	instances := instanceNumbers(u.Config)
+	for i, cu := range cus {
+		if i >= len(instances) {
+			c.removeControllerUnit(cu)
+			resp.AddMsg("unit %q: removed", cu.name)
+			continue
+		}
+		err := c.updateControllerUnit(cu, u, instances[i])
+		if err != nil {
+			resp.AddError(err)
+			return resp
+		}
 	}
-	err = cu.guard.UpdateOpts(
-		WithArgs(u.Config.Args...),
-		WithEnv(env...),
-		WithWd(u.Dir),
-		WithRestartAfter(time.Second*time.Duration(u.Config.RestartAfterSec)),
-		WithOnChange(func(rs GuardRunningState, pid int) {
-			switch rs {
-			case GuardStatusRunningStarted:
-				c.statCache.started(u.Name, pid)
-			case GuardStatusRunningStopped:
-				c.statCache.stopped(u.Name)
-			}
-		}),
-	)
-	if err != nil {
-		resp.AddError(errors.Wrapf(err, "%q: update-guard-options", cu.unit.Name))
-		return resp
+	for n := len(cus); n < len(instances); n++ {
+		i := instances[n]
+		cu, err := c.newControllerUnit(u, i)
+		if err != nil {
+			resp.AddError(err)
+			return resp
+		}
+		c.Lock()
+		c.units = append(c.units, cu)
+		c.runGuard(cu)
+		c.Unlock()
+		c.registerUnit(cu)
+		resp.AddMsg("unit %q: added", cu.name)
 	}
-	resp.AddMsg("unit %q: updated", cu.unit.Name)
+	resp.AddMsg("unit %q: updated", unit)
 
 	//
-	if !cu.unit.Config.Enabled {
-		resp.AddMsg("unit %q: disabled", cu.unit.Name)
+	if !u.Config.Enabled {
+		resp.AddMsg("unit %q: disabled", unit)
 		return
 	}
 	if !wasRunning {
-		resp.AddMsg("unit %q: not started (was not running before)", cu.unit.Name)
+		resp.AddMsg("unit %q: not started (was not running before)", unit)
 		return
 	}
+	for _, cu := range c.unitInstances(unit) {
+		pid, err := cu.guard.Start()
+		if err != nil {
+			resp.Errorf("starting unit %q: %v", cu.name, err)
+		} else {
+			resp.AddMsg("started %q with PID %d", cu.name, pid)
+		}
+	}
+	return
+}
 
-	pid, err := cu.guard.Start()
+// updateControllerUnit applies the updated unit u to the stopped instance cu
+func (c *Controller) updateControllerUnit(cu *controllerUnit, u Unit, instance int) error {
+	oldName, oldCgroup := cu.name, cu.cgroup
+	c.Lock()
+	cu.unit = u
+	cu.instance = instance
+	cu.name = instanceName(u.Name, instance)
+	cu.health = c.healthMonitor(cu)
+	cu.watchdog = newWatchdog(u.Config.Watchdog)
+	cu.schedule = newUnitSchedule(u.Config, time.Now())
+	c.Unlock()
+	if cu.name != oldName {
+		// the instance was renamed, as the number of instances changed from or to 1
+		c.statCache.remove(oldName)
+		c.statCache.add(cu.name, u.Config.Enabled)
+		c.statCache.setInstance(cu.name, u.Name, instance)
+	}
+	c.statCache.healthChanged(cu.name, cu.health)
+	c.openLogs(cu)
+	err := c.setupCgroup(cu)
 	if err != nil {
-		resp.Errorf("starting unit %q: %v", cu.unit.Name, err)
-	} else {
-		resp.AddMsg("started %q with PID %d", cu.unit.Name, pid)
+		return err
 	}
-	return
+	if oldCgroup != "" && oldCgroup != cu.cgroup {
+		if err := removeCgroup(oldCgroup); err != nil {
+			log.Warnf("controller: %q: %v", cu.name, err)
+		}
+	}
+	c.statCache.setCgroup(cu.name, cu.cgroup)
+	c.statCache.setSchedule(cu.name, cu.schedule)
+	err = c.setupSockets(cu)
+	if err != nil {
+		return err
+	}
+	c.statCache.setSockets(cu.name, cu.sockets.addresses())
+
+	//update guard
+	err = cu.guard.UpdateOpts(c.guardOpts(cu)...)
+	if err != nil {
+		return errors.Wrapf(err, "%q: update-guard-options", cu.name)
+	}
+	return nil
 }
@@ -3,6 +3,8 @@ package copr
 import (
 	"fmt"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mazzegi/log"
 	"github.com/pkg/errors"
@@ -91,8 +93,43 @@ type (
 		unit    string
 		dir     string
 	}
+	CommandRestart struct {
+		resultC chan CommandResponse
+		unit    string
+	}
+	CommandRestartAll struct {
+		resultC chan CommandResponse
+		opts    RestartAllOptions
+	}
+	CommandReload struct {
+		resultC chan CommandResponse
+		unit    string
+	}
+	CommandRemove struct {
+		resultC     chan CommandResponse
+		unit        string
+		keepArchive bool
+	}
+	CommandSignal struct {
+		resultC chan CommandResponse
+		unit    string
+		sig     syscall.Signal
+		group   bool
+	}
 )
 
+// RestartAllOptions control a rolling restart of all running units
+type RestartAllOptions struct {
+	// Parallel is the number of units, which are restarted at once
+	Parallel int
+	// Pause is the time between two batches of restarts
+	Pause time.Duration
+	// WaitHealthy waits for the restarted units with health checks to become healthy, before the next batch is restarted
+	WaitHealthy bool
+	// HealthTimeout is the time the restarted units have to become healthy
+	HealthTimeout time.Duration
+}
+
 func NewCommandStartAll() *CommandStartAll {
 	return &CommandStartAll{resultC: make(chan CommandResponse)}
 }
@@ -121,6 +158,26 @@ func NewCommandDeploy(unit string, dir string) *CommandDeploy {
 	return &CommandDeploy{resultC: make(chan CommandResponse), unit: unit, dir: dir}
 }
 
+func NewCommandRestart(unit string) *CommandRestart {
+	return &CommandRestart{resultC: make(chan CommandResponse), unit: unit}
+}
+
+func NewCommandRestartAll(opts RestartAllOptions) *CommandRestartAll {
+	return &CommandRestartAll{resultC: make(chan CommandResponse), opts: opts}
+}
+
+func NewCommandReload(unit string) *CommandReload {
+	return &CommandReload{resultC: make(chan CommandResponse), unit: unit}
+}
+
+func NewCommandRemove(unit string, keepArchive bool) *CommandRemove {
+	return &CommandRemove{resultC: make(chan CommandResponse), unit: unit, keepArchive: keepArchive}
+}
+
+func NewCommandSignal(unit string, sig syscall.Signal, group bool) *CommandSignal {
+	return &CommandSignal{resultC: make(chan CommandResponse), unit: unit, sig: sig, group: group}
+}
+
 // API
 func (c *Controller) StartAll() CommandResponse {
 	cmd := NewCommandStartAll()
@@ -183,14 +240,71 @@ func (c *Controller) Deploy(unit string, dir string) CommandResponse {
 	return resp
 }
 
+func (c *Controller) Restart(unit string) CommandResponse {
+	cmd := NewCommandRestart(unit)
+	c.commandC <- cmd
+	resp := <-cmd.resultC
+	return resp
+}
+
+func (c *Controller) RestartAll(opts RestartAllOptions) CommandResponse {
+	cmd := NewCommandRestartAll(opts)
+	c.commandC <- cmd
+	resp := <-cmd.resultC
+	return resp
+}
+
+func (c *Controller) Reload(unit string) CommandResponse {
+	cmd := NewCommandReload(unit)
+	c.commandC <- cmd
+	resp := <-cmd.resultC
+	return resp
+}
+
+// Remove stops all instances of unit and deletes it. With keepArchive, the unit dir is archived before.
+func (c *Controller) Remove(unit string, keepArchive bool) CommandResponse {
+	cmd := NewCommandRemove(unit, keepArchive)
+	c.commandC <- cmd
+	resp := <-cmd.resultC
+	return resp
+}
+
+// Signal sends sig to the main process of unit or, with group, to its process group
+func (c *Controller) Signal(unit string, sig syscall.Signal, group bool) CommandResponse {
+	cmd := NewCommandSignal(unit, sig, group)
+	c.commandC <- cmd
+	resp := <-cmd.resultC
+	return resp
+}
+
 func (c *Controller) Stat(unit string) CommandResponse {
 	var resp CommandResponse
-	sd, err := c.statCache.statsDescriptor(unit)
-	if err != nil {
-		resp.AddError(errors.Wrapf(err, "stats-descriptor of %q", unit))
+	sds := c.statCache.statsDescriptors(unit)
+	if len(sds) == 0 {
+		resp.AddError(errors.Errorf("stats-descriptor of %q: no such unit", unit))
 		return resp
 	}
-	return CommandResponse{Data: sd, Messages: []string{sd.String()}}
+	if len(sds) == 1 {
+		resp.Data = sds[0]
+	} else {
+		resp.Data = sds
+	}
+	for _, sd := range sds {
+		resp.AddMsg(sd.String())
+		if len(sd.RLimits) > 0 {
+			resp.AddMsg("  rlimits: %s", rlimitsString(sd.RLimits))
+		}
+		for i := len(sd.ExitHistory) - 1; i >= 0; i-- {
+			resp.AddMsg("  exit: %s", sd.ExitHistory[i])
+		}
+		for i := len(sd.WatchdogEvents) - 1; i >= 0; i-- {
+			resp.AddMsg("  watchdog: %s", sd.WatchdogEvents[i])
+		}
+		for _, sp := range sd.Strays {
+			resp.AddMsg("  stray: %s", sp)
+		}
+	}
+	return resp
 }
 
 func (c *Controller) StatAll() CommandResponse {
@@ -201,3 +315,15 @@ func (c *Controller) StatAll() CommandResponse {
 	}
 	return resp
 }
+
+// UnitLogs returns the log ring and the log file path of stdout or stderr of unit
+func (c *Controller) UnitLogs(unit string, stderr bool) (*LogRing, string, error) {
+	c.RLock()
+	defer c.RUnlock()
+	cu, err := c.findUnit(unit)
+	if err != nil {
+		return nil, "", err
+	}
+	ring, path := cu.logs.stream(stderr)
+	return ring, path, nil
+}
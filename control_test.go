@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -345,3 +346,515 @@ func TestControllerDeploy(t *testing.T) {
 	}
 
 }
+
+func writeTestUnitConfig(dir string, uc UnitConfig) error {
+	unitFilePath := filepath.Join(dir, "copr.unit.json")
+	unitF, err := os.Create(unitFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "create-file %q", unitFilePath)
+	}
+	defer unitF.Close()
+	enc := json.NewEncoder(unitF)
+	enc.SetIndent("", "  ")
+	return enc.Encode(uc)
+}
+
+func TestControllerInstances(t *testing.T) {
+	tmpDir := "tmp_instances"
+	unitsDir := filepath.Join(tmpDir, "units")
+	unitDir := filepath.Join(unitsDir, "worker")
+	err := os.MkdirAll(unitDir, os.ModePerm)
+	assertNoErr(t, err, "mkdirall %q", unitDir)
+	defer os.RemoveAll(tmpDir)
+
+	prgName := "test_unit"
+	assertNoErr(t, buildPrg(unitDir, prgName), "build-prg")
+	uc := UnitConfig{
+		Enabled:         true,
+		Program:         prgName,
+		Args:            []string{"-bind=127.0.0.1:{port}"},
+		Env:             []string{"instance={instance}"},
+		RestartAfterSec: 1,
+		Instances:       2,
+		BasePort:        31011,
+	}
+	assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+
+	checkStatusAfter := 50 * time.Millisecond
+	assertNoErr(t, ctrl.Start("worker#2").Error(), "start instance 2")
+	<-time.After(checkStatusAfter)
+	assertUnitNotRunning(t, 11)
+	assertUnitRunning(t, 12)
+	assertUnitEnv(t, 12, "instance", "2")
+
+	assertNoErr(t, ctrl.Start("worker").Error(), "start all instances")
+	<-time.After(checkStatusAfter)
+	assertUnitRunning(t, 11)
+	assertUnitEnv(t, 11, "instance", "1")
+
+	resp := ctrl.Stat("worker")
+	assertNoErr(t, resp.Error(), "stat")
+	sds, ok := resp.Data.([]StatsDescriptor)
+	assertEqual(t, true, ok, "stats of all instances")
+	assertEqual(t, 2, len(sds), "number of instance stats")
+	assertEqual(t, "worker#1", sds[0].Name, "name of instance 1")
+	assertEqual(t, 1, sds[0].Instance, "instance 1")
+	assertErr(t, ctrl.Disable("worker#1").Error(), "disable single instance")
+
+	// scale up
+	deployDir := filepath.Join(tmpDir, "deployment")
+	assertNoErr(t, os.MkdirAll(deployDir, os.ModePerm), "mkdirall %q", deployDir)
+	assertNoErr(t, buildPrg(deployDir, prgName), "build-prg")
+	uc.Instances = 3
+	assertNoErr(t, writeTestUnitConfig(deployDir, uc), "write unit config")
+	assertNoErr(t, ctrl.Deploy("worker", deployDir).Error(), "deploy 3 instances")
+	<-time.After(checkStatusAfter)
+	for i := 11; i <= 13; i++ {
+		assertUnitRunning(t, i)
+	}
+
+	// scale down to a single instance
+	assertNoErr(t, os.MkdirAll(deployDir, os.ModePerm), "mkdirall %q", deployDir)
+	assertNoErr(t, buildPrg(deployDir, prgName), "build-prg")
+	uc.Instances = 1
+	assertNoErr(t, writeTestUnitConfig(deployDir, uc), "write unit config")
+	assertNoErr(t, ctrl.Deploy("worker", deployDir).Error(), "deploy 1 instance")
+	<-time.After(checkStatusAfter)
+	assertUnitRunning(t, 11)
+	assertUnitNotRunning(t, 12)
+	assertUnitNotRunning(t, 13)
+	resp = ctrl.Stat("worker")
+	assertNoErr(t, resp.Error(), "stat")
+	sd, ok := resp.Data.(StatsDescriptor)
+	assertEqual(t, true, ok, "stats of single instance")
+	assertEqual(t, "worker", sd.Name, "name of single instance")
+	assertEqual(t, true, sd.Started, "single instance started")
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
+
+func TestControllerDeployOverlap(t *testing.T) {
+	tmpDir := "tmp_deploy_overlap"
+	unitsDir := filepath.Join(tmpDir, "units")
+	unitDir := filepath.Join(unitsDir, "web")
+	err := os.MkdirAll(unitDir, os.ModePerm)
+	assertNoErr(t, err, "mkdirall %q", unitDir)
+	defer os.RemoveAll(tmpDir)
+
+	prgName := "test_unit"
+	assertNoErr(t, buildPrg(unitDir, prgName), "build-prg")
+	uc := UnitConfig{
+		Enabled:         true,
+		Program:         prgName,
+		Args:            []string{"-bind=127.0.0.1:{port}"},
+		Env:             []string{"version=1"},
+		RestartAfterSec: 1,
+		BasePort:        31021,
+		Health:          &HealthConfig{Type: HealthCheckTCP, Address: "127.0.0.1:{port}"},
+		Deploy:          &DeployConfig{Strategy: string(DeployOverlap), AltPortOffset: 10, HealthyTimeoutSec: 2},
+	}
+	assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+
+	checkStatusAfter := 50 * time.Millisecond
+	assertNoErr(t, ctrl.Start("web").Error(), "start")
+	<-time.After(checkStatusAfter)
+	assertUnitEnv(t, 21, "version", "1")
+
+	deploy := func(uc UnitConfig) CommandResponse {
+		deployDir := filepath.Join(tmpDir, "deployment")
+		assertNoErr(t, os.MkdirAll(deployDir, os.ModePerm), "mkdirall %q", deployDir)
+		assertNoErr(t, buildPrg(deployDir, prgName), "build-prg")
+		assertNoErr(t, writeTestUnitConfig(deployDir, uc), "write unit config")
+		return ctrl.Deploy("web", deployDir)
+	}
+
+	// the new version starts on the alternate port and replaces the old one, when it is healthy
+	uc.Env = []string{"version=2"}
+	assertNoErr(t, deploy(uc).Error(), "deploy version 2")
+	assertUnitEnv(t, 31, "version", "2")
+	<-time.After(checkStatusAfter)
+	assertUnitNotRunning(t, 21)
+	sd, err := ctrl.statCache.statsDescriptor("web")
+	assertNoErr(t, err, "stats")
+	assertEqual(t, true, sd.Started, "started after overlap deploy")
+
+	// a new version, which doesn't become healthy, is rolled back
+	uc.Env = []string{"version=3"}
+	uc.Health = &HealthConfig{Type: HealthCheckTCP, Address: "127.0.0.1:31099"}
+	assertErr(t, deploy(uc).Error(), "deploy unhealthy version 3")
+	<-time.After(checkStatusAfter)
+	assertUnitEnv(t, 31, "version", "2")
+	assertUnitNotRunning(t, 21)
+	ruc, err := ReadUnitConfig(unitDir)
+	assertNoErr(t, err, "read restored unit config")
+	assertEqual(t, "version=2", ruc.Env[0], "restored unit config")
+
+	// the old version doesn't restart with the new program during the overlap, but after the rollback
+	deployRespC := make(chan CommandResponse)
+	go func() {
+		deployRespC <- deploy(uc)
+	}()
+	// the new version runs on the alternate port, while the overlap lasts
+	for i := 0; ; i++ {
+		_, err := sendRequest("http://127.0.0.1:31021", coprtest.TestCommand{Action: coprtest.TestActionProbe})
+		if err == nil {
+			break
+		}
+		if i >= 100 {
+			t.Fatalf("new version didn't start: %v", err)
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	cu, err := ctrl.findUnit("web")
+	assertNoErr(t, err, "find unit")
+	assertNoErr(t, syscall.Kill(cu.guard.PID(), syscall.SIGKILL), "kill old version")
+	<-time.After(1300 * time.Millisecond)
+	assertUnitNotRunning(t, 31)
+	assertErr(t, (<-deployRespC).Error(), "deploy unhealthy version 3 again")
+	<-time.After(checkStatusAfter)
+	assertUnitEnv(t, 31, "version", "2")
+
+	// remove waits for the guard of the new version, which took over the instance
+	cu, err = ctrl.findUnit("web")
+	assertNoErr(t, err, "find unit")
+	guard, guardDoneC := cu.guard, cu.guardDoneC
+	select {
+	case <-guardDoneC:
+		t.Fatalf("guard of the new version is done before remove")
+	default:
+	}
+	assertNoErr(t, ctrl.Remove("web", false).Error(), "remove")
+	select {
+	case <-guardDoneC:
+	default:
+		t.Fatalf("guard of the new version isn't done after remove")
+	}
+	assertEqual(t, GuardStatusNotRunning, guard.Status().RunningState, "guard state after remove")
+	_, err = os.Stat(unitDir)
+	assertEqual(t, true, os.IsNotExist(err), "unit dir after remove")
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
+
+func TestControllerRestartReload(t *testing.T) {
+	tmpDir := "tmp_restart"
+	unitsDir := filepath.Join(tmpDir, "units")
+	defer os.RemoveAll(tmpDir)
+	// the script appends a line to reloads.txt in its dir on every SIGUSR1
+	script := "#!/bin/sh\ntrap 'echo reloaded >> reloads.txt' USR1\nwhile true; do sleep 0.05; done\n"
+	for _, name := range []string{"alpha", "beta"} {
+		unitDir := filepath.Join(unitsDir, name)
+		assertNoErr(t, os.MkdirAll(unitDir, os.ModePerm), "mkdirall %q", unitDir)
+		assertNoErr(t, os.WriteFile(filepath.Join(unitDir, "run.sh"), []byte(script), 0755), "write script")
+		uc := UnitConfig{
+			Enabled:         true,
+			Program:         "run.sh",
+			RestartAfterSec: 1,
+			ReloadSignal:    "SIGUSR1",
+		}
+		assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+	}
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+
+	pids := func() map[string]int {
+		sds, ok := ctrl.StatAll().Data.([]StatsDescriptor)
+		assertEqual(t, true, ok, "stats of all units")
+		m := map[string]int{}
+		for _, sd := range sds {
+			m[sd.Name] = sd.PID
+		}
+		return m
+	}
+
+	assertNoErr(t, ctrl.StartAll().Error(), "start-all")
+	<-time.After(100 * time.Millisecond)
+	before := pids()
+
+	assertNoErr(t, ctrl.Reload("alpha").Error(), "reload")
+	<-time.After(200 * time.Millisecond)
+	bs, err := os.ReadFile(filepath.Join(unitsDir, "alpha", "reloads.txt"))
+	assertNoErr(t, err, "read reloads")
+	assertEqual(t, "reloaded\n", string(bs), "reloads")
+	assertEqual(t, before["alpha"], pids()["alpha"], "pid after reload")
+
+	assertNoErr(t, ctrl.Restart("alpha").Error(), "restart")
+	after := pids()
+	assertEqual(t, true, after["alpha"] != before["alpha"], "new pid after restart")
+	assertEqual(t, before["beta"], after["beta"], "pid of other unit after restart")
+
+	// the rolling restart runs aside the command loop and refuses concurrent removals
+	restartDoneC := make(chan CommandResponse)
+	go func() {
+		restartDoneC <- ctrl.RestartAll(RestartAllOptions{Parallel: 1, Pause: 500 * time.Millisecond})
+	}()
+	<-time.After(200 * time.Millisecond)
+	t0 := time.Now()
+	pids()
+	assertEqual(t, true, time.Since(t0) < 200*time.Millisecond, "stat during rolling restart")
+	assertErr(t, ctrl.Remove("beta", false).Error(), "remove during rolling restart")
+	resp := <-restartDoneC
+	assertNoErr(t, resp.Error(), "restart-all")
+	final := pids()
+	for name, pid := range after {
+		assertEqual(t, true, final[name] != 0 && final[name] != pid, "new pid of %q after restart-all", name)
+	}
+	assertErr(t, ctrl.Restart("gamma").Error(), "restart unknown unit")
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
+
+func TestControllerRemove(t *testing.T) {
+	tmpDir := "tmp_remove"
+	unitsDir := filepath.Join(tmpDir, "units")
+	defer os.RemoveAll(tmpDir)
+	script := "#!/bin/sh\nexec sleep 60\n"
+	for name, deps := range map[string][]string{"db": nil, "app": {"db"}} {
+		unitDir := filepath.Join(unitsDir, name)
+		assertNoErr(t, os.MkdirAll(unitDir, os.ModePerm), "mkdirall %q", unitDir)
+		assertNoErr(t, os.WriteFile(filepath.Join(unitDir, "run.sh"), []byte(script), 0755), "write script")
+		uc := UnitConfig{
+			Enabled:         true,
+			Program:         "run.sh",
+			RestartAfterSec: 1,
+			DependsOn:       deps,
+		}
+		assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+	}
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+	archives := func() int {
+		fis, err := os.ReadDir(filepath.Join(unitsDir, archiveDir))
+		assertNoErr(t, err, "read archive dir")
+		return len(fis)
+	}
+
+	assertNoErr(t, ctrl.StartAll().Error(), "start-all")
+	<-time.After(100 * time.Millisecond)
+	assertErr(t, ctrl.Remove("db", true).Error(), "remove unit with dependents")
+	assertErr(t, ctrl.Remove("nope", true).Error(), "remove unknown unit")
+
+	ring, _, err := ctrl.UnitLogs("app", false)
+	assertNoErr(t, err, "unit logs")
+	_, _, lineC, cancelLines := ring.Subscribe(0)
+	defer cancelLines()
+	assertNoErr(t, ctrl.Remove("app", false).Error(), "remove without archive")
+	// followers of the logs of a removed unit are done
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-lineC:
+		case <-timeout:
+			t.Fatalf("log subscription not closed after remove")
+		}
+	}
+	_, err = os.Stat(filepath.Join(unitsDir, "app"))
+	assertEqual(t, true, os.IsNotExist(err), "unit dir after remove")
+	assertEqual(t, 0, archives(), "archives after remove without archive")
+	assertErr(t, ctrl.Stat("app").Error(), "stat of removed unit")
+
+	// a failing archive keeps the unit
+	archivePath := filepath.Join(unitsDir, archiveDir)
+	assertNoErr(t, os.Rename(archivePath, archivePath+".moved"), "move archive dir")
+	assertNoErr(t, os.WriteFile(archivePath, nil, 0644), "block archive dir")
+	assertErr(t, ctrl.Remove("db", true).Error(), "remove with failing archive")
+	_, err = os.Stat(filepath.Join(unitsDir, "db"))
+	assertNoErr(t, err, "unit dir after failed remove")
+	assertNoErr(t, ctrl.Stat("db").Error(), "stat after failed remove")
+	assertNoErr(t, ctrl.Start("db").Error(), "start after failed remove")
+	assertNoErr(t, os.Remove(archivePath), "unblock archive dir")
+	assertNoErr(t, os.Rename(archivePath+".moved", archivePath), "restore archive dir")
+
+	assertNoErr(t, ctrl.Remove("db", true).Error(), "remove with archive")
+	assertEqual(t, 1, archives(), "archives after remove")
+	assertEqual(t, 0, len(ctrl.StatAll().Data.([]StatsDescriptor)), "stats after remove")
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
+
+func TestControllerMissingDependency(t *testing.T) {
+	tmpDir := "tmp_missing_dependency"
+	unitsDir := filepath.Join(tmpDir, "units")
+	defer os.RemoveAll(tmpDir)
+	script := "#!/bin/sh\nexec sleep 60\n"
+	for name, deps := range map[string][]string{"ok": nil, "orphan": {"gone"}} {
+		unitDir := filepath.Join(unitsDir, name)
+		assertNoErr(t, os.MkdirAll(unitDir, os.ModePerm), "mkdirall %q", unitDir)
+		assertNoErr(t, os.WriteFile(filepath.Join(unitDir, "run.sh"), []byte(script), 0755), "write script")
+		uc := UnitConfig{
+			Enabled:         true,
+			Program:         "run.sh",
+			RestartAfterSec: 1,
+			DependsOn:       deps,
+		}
+		assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+	}
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller with missing dependency")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+
+	assertErr(t, ctrl.StartAll().Error(), "start-all with missing dependency")
+	resp := ctrl.Stat("ok")
+	assertNoErr(t, resp.Error(), "stat")
+	assertEqual(t, true, resp.Data.(StatsDescriptor).Started, "unit without dependencies started")
+	resp = ctrl.Stat("orphan")
+	assertNoErr(t, resp.Error(), "stat")
+	assertEqual(t, false, resp.Data.(StatsDescriptor).Started, "unit with missing dependency started")
+	assertErr(t, ctrl.Start("orphan").Error(), "start unit with missing dependency")
+
+	cancel()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
+
+func TestControllerWaitDependencies(t *testing.T) {
+	tmpDir := "tmp_wait_dependencies"
+	unitsDir := filepath.Join(tmpDir, "units")
+	defer os.RemoveAll(tmpDir)
+	script := "#!/bin/sh\nexec sleep 60\n"
+	for name, deps := range map[string][]string{"db": nil, "app": {"db"}} {
+		unitDir := filepath.Join(unitsDir, name)
+		assertNoErr(t, os.MkdirAll(unitDir, os.ModePerm), "mkdirall %q", unitDir)
+		assertNoErr(t, os.WriteFile(filepath.Join(unitDir, "run.sh"), []byte(script), 0755), "write script")
+		uc := UnitConfig{
+			Enabled:         true,
+			Program:         "run.sh",
+			RestartAfterSec: 1,
+			DependsOn:       deps,
+		}
+		if name == "db" {
+			// db doesn't become healthy within the test
+			uc.Health = &HealthConfig{Type: HealthCheckTCP, Address: "127.0.0.1:31097", StartPeriodSec: 60}
+		}
+		assertNoErr(t, writeTestUnitConfig(unitDir, uc), "write unit config")
+	}
+
+	sec, err := NewSecrets(filepath.Join(unitsDir, "copr.secrets"), "controller-test-pwd")
+	assertNoErr(t, err, "new-secrets")
+	ctrl, err := NewController(unitsDir, sec, map[string]string{})
+	assertNoErr(t, err, "new-controller")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrlDoneC := make(chan struct{})
+	go func() {
+		defer close(ctrlDoneC)
+		ctrl.RunCtx(ctx)
+	}()
+
+	assertNoErr(t, ctrl.Start("db").Error(), "start db")
+	startRespC := make(chan CommandResponse)
+	go func() {
+		startRespC <- ctrl.Start("app")
+	}()
+	<-time.After(300 * time.Millisecond)
+
+	// the waiting start doesn't block other commands, and a stop makes it give up
+	t0 := time.Now()
+	resp := ctrl.Stat("app")
+	assertNoErr(t, resp.Error(), "stat while waiting")
+	assertEqual(t, true, time.Since(t0) < 200*time.Millisecond, "stat while waiting")
+	assertNoErr(t, ctrl.Stop("app").Error(), "stop while waiting")
+	select {
+	case resp = <-startRespC:
+	case <-time.After(time.Second):
+		t.Fatalf("start didn't give up after stop")
+	}
+	assertErr(t, resp.Error(), "start after stop")
+	resp = ctrl.Stat("app")
+	assertNoErr(t, resp.Error(), "stat")
+	assertEqual(t, false, resp.Data.(StatsDescriptor).Started, "started after stop")
+
+	// a canceled controller fails the waiting start
+	go func() {
+		startRespC <- ctrl.Start("app")
+	}()
+	<-time.After(300 * time.Millisecond)
+	cancel()
+	select {
+	case resp = <-startRespC:
+	case <-time.After(time.Second):
+		t.Fatalf("start didn't give up after cancel")
+	}
+	assertErr(t, resp.Error(), "start after cancel")
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("controller didn't finish after 5 secs")
+	case <-ctrlDoneC:
+	}
+}
@@ -0,0 +1,130 @@
+package copr
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Credential are the ids, a unit process runs with
+type Credential struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+}
+
+func (c Credential) String() string {
+	var gs []string
+	for _, g := range c.Groups {
+		gs = append(gs, strconv.FormatUint(uint64(g), 10))
+	}
+	return fmt.Sprintf("uid=%d, gid=%d, groups=[%s]", c.UID, c.GID, strings.Join(gs, ","))
+}
+
+func (c Credential) sysCredential() *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    c.UID,
+		Gid:    c.GID,
+		Groups: c.Groups,
+	}
+}
+
+// isCurrent checks if the credential is the one of coprd itself, so that it doesn't need to be applied
+func (c Credential) isCurrent() bool {
+	return int(c.UID) == os.Geteuid() && int(c.GID) == os.Getegid() && len(c.Groups) == 0
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroupID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(g.Gid)
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid id %q", s)
+	}
+	return uint32(id), nil
+}
+
+// resolveCredential resolves user, group and supplementary groups, given as names or numeric ids.
+// Without a group, the primary group of the user is used. Without a user, the user of coprd is kept.
+// It returns nil, if nothing is configured.
+func resolveCredential(userName string, groupName string, groups []string) (*Credential, error) {
+	if userName == "" && groupName == "" && len(groups) == 0 {
+		return nil, nil
+	}
+	cred := &Credential{
+		UID: uint32(os.Geteuid()),
+		GID: uint32(os.Getegid()),
+	}
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup user %q", userName)
+		}
+		if cred.UID, err = parseID(u.Uid); err != nil {
+			return nil, err
+		}
+		if cred.GID, err = parseID(u.Gid); err != nil {
+			return nil, err
+		}
+	}
+	if groupName != "" {
+		gid, err := lookupGroupID(groupName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup group %q", groupName)
+		}
+		cred.GID = gid
+	}
+	for _, g := range groups {
+		gid, err := lookupGroupID(g)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lookup group %q", g)
+		}
+		cred.Groups = append(cred.Groups, gid)
+	}
+	return cred, nil
+}
+
+// chownDir changes the ownership of dir and everything below to cred
+func chownDir(dir string, cred Credential) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		err = os.Lchown(path, int(cred.UID), int(cred.GID))
+		if err != nil {
+			return privilegeErr(err, "chown %q to %d:%d", path, cred.UID, cred.GID)
+		}
+		return nil
+	})
+}
+
+// privilegeErr wraps err and adds a hint, if it's caused by missing privileges of coprd
+func privilegeErr(err error, format string, args ...any) error {
+	if errors.Is(err, syscall.EPERM) {
+		return errors.Wrapf(err, format+" (coprd lacks the privileges, it must run as root or with CAP_SETUID, CAP_SETGID and CAP_CHOWN)", args...)
+	}
+	return errors.Wrapf(err, format, args...)
+}
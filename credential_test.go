@@ -0,0 +1,36 @@
+package copr
+
+import (
+	"testing"
+)
+
+func TestResolveCredential(t *testing.T) {
+	cred, err := resolveCredential("", "", nil)
+	assertNoErr(t, err, "resolve empty")
+	assertEqual(t, true, cred == nil, "empty credential is nil")
+
+	tests := map[string]struct {
+		user    string
+		group   string
+		groups  []string
+		want    string
+		invalid bool
+	}{
+		"user-name":     {user: "root", want: "uid=0, gid=0, groups=[]"},
+		"user-id":       {user: "0", want: "uid=0, gid=0, groups=[]"},
+		"group-ids":     {user: "root", group: "65534", groups: []string{"1", "2"}, want: "uid=0, gid=65534, groups=[1,2]"},
+		"unknown-user":  {user: "no-such-user-for-copr", invalid: true},
+		"unknown-group": {user: "root", group: "no-such-group-for-copr", invalid: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cred, err := resolveCredential(test.user, test.group, test.groups)
+			if test.invalid {
+				assertErr(t, err, "resolve")
+				return
+			}
+			assertNoErr(t, err, "resolve")
+			assertEqual(t, test.want, cred.String(), "credential")
+		})
+	}
+}
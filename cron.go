@@ -0,0 +1,186 @@
+package copr
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CronSchedule is a parsed cron expression with the five fields minute, hour, day of month, month and day of week.
+// Fields support *, lists (1,2), ranges (1-5), steps (*/15, 1-30/2) and names for months and weekdays.
+type CronSchedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// if both, day of month and day of week, are restricted, a day matches if either matches.
+	// Like in Vixie cron, a field starting with "*", like "*/2", isn't a restriction.
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day-of-month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{name: "day-of-week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+	fs := strings.Fields(spec)
+	if len(fs) != 5 {
+		return nil, errors.Errorf("cron expression %q: expected 5 fields, got %d", expr, len(fs))
+	}
+	cs := &CronSchedule{
+		expr:    expr,
+		domStar: strings.HasPrefix(fs[2], "*"),
+		dowStar: strings.HasPrefix(fs[4], "*"),
+	}
+	var err error
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronMinute, &cs.minute},
+		{cronHour, &cs.hour},
+		{cronDom, &cs.dom},
+		{cronMonth, &cs.month},
+		{cronDow, &cs.dow},
+	} {
+		*f.bits, err = f.field.parse(fs[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cron expression %q", expr)
+		}
+	}
+	// 7 is sunday as well
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	return cs, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.Errorf("%s: invalid value %q", f.name, s)
+	}
+	return v, nil
+}
+
+// parse parses a field to a bitset of the matching values
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, errors.Errorf("%s: invalid step %q", f.name, stepStr)
+			}
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			los, his, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(los); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(his); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, errors.Errorf("%s: invalid range %q", f.name, rng)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if !hasStep {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (cs *CronSchedule) String() string {
+	return cs.expr
+}
+
+func (cs *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time after t, which matches the schedule. It returns the zero time, if there is none within 5 years.
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
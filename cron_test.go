@@ -0,0 +1,59 @@
+package copr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-03-15 is a friday
+	from := time.Date(2024, 3, 15, 10, 30, 20, 0, time.UTC)
+	tests := map[string]struct {
+		expr string
+		want time.Time
+	}{
+		"every-minute":  {expr: "* * * * *", want: time.Date(2024, 3, 15, 10, 31, 0, 0, time.UTC)},
+		"every-15-min":  {expr: "*/15 * * * *", want: time.Date(2024, 3, 15, 10, 45, 0, 0, time.UTC)},
+		"nightly":       {expr: "30 2 * * *", want: time.Date(2024, 3, 16, 2, 30, 0, 0, time.UTC)},
+		"daily-macro":   {expr: "@daily", want: time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)},
+		"list":          {expr: "0 9,18 * * *", want: time.Date(2024, 3, 15, 18, 0, 0, 0, time.UTC)},
+		"range-step":    {expr: "0 1-11/2 * * *", want: time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		"weekdays":      {expr: "0 8 * * mon-fri", want: time.Date(2024, 3, 18, 8, 0, 0, 0, time.UTC)},
+		"sunday-7":      {expr: "0 0 * * 7", want: time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		"month-name":    {expr: "0 0 1 jun *", want: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		"leap-day":      {expr: "0 0 29 2 *", want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		"dom-or-dow":    {expr: "0 0 20 * mon", want: time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+		"dom-step-dow":  {expr: "0 0 */2 * 1", want: time.Date(2024, 3, 25, 0, 0, 0, 0, time.UTC)},
+		"dom-dow-step":  {expr: "0 0 18 * */2", want: time.Date(2024, 4, 18, 0, 0, 0, 0, time.UTC)},
+		"exact-minute":  {expr: "31 10 15 3 *", want: time.Date(2024, 3, 15, 10, 31, 0, 0, time.UTC)},
+		"next-year":     {expr: "0 0 1 1 *", want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"never-matches": {expr: "0 0 31 2 *", want: time.Time{}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cs, err := ParseCronSchedule(test.expr)
+			assertNoErr(t, err, "parse %q", test.expr)
+			assertEqual(t, test.want, cs.Next(from), "next of %q", test.expr)
+		})
+	}
+}
+
+func TestCronScheduleInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@sometimes",
+	} {
+		_, err := ParseCronSchedule(expr)
+		assertErr(t, err, "parse %q", expr)
+	}
+}
@@ -0,0 +1,321 @@
+package copr
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/mazzegi/log"
+	"github.com/pkg/errors"
+)
+
+type DeployStrategy string
+
+const (
+	// DeployRestart stops the running instances, replaces the unit and starts them again
+	DeployRestart DeployStrategy = "restart"
+	// DeployOverlap starts the new version alongside the old one and stops the old one, when the new one is healthy
+	DeployOverlap DeployStrategy = "overlap"
+)
+
+const (
+	defaultDeployHealthyTimeout = 60 * time.Second
+	overlapProbeInterval        = 500 * time.Millisecond
+)
+
+// DeployConfig configures how a running unit is updated
+type DeployConfig struct {
+	Strategy string `json:"strategy,omitempty"`
+	// AltPortOffset is added to the ports of the new version, if the unit has no sockets to share.
+	// The offset is removed again with the next overlapping deploy.
+	AltPortOffset int `json:"alt-port-offset,omitempty"`
+	// HealthyTimeoutSec is the time the new version has to become healthy, before it is rolled back
+	HealthyTimeoutSec int `json:"healthy-timeout-sec,omitempty"`
+}
+
+func (dc DeployConfig) Validate() error {
+	switch DeployStrategy(dc.Strategy) {
+	case "", DeployRestart, DeployOverlap:
+	default:
+		return errors.Errorf("invalid strategy %q", dc.Strategy)
+	}
+	if dc.AltPortOffset < 0 {
+		return errors.Errorf("alt-port-offset must not be negative")
+	}
+	if dc.HealthyTimeoutSec < 0 {
+		return errors.Errorf("healthy-timeout-sec must not be negative")
+	}
+	return nil
+}
+
+func (uc UnitConfig) deployStrategy() DeployStrategy {
+	if uc.Deploy == nil || uc.Deploy.Strategy == "" {
+		return DeployRestart
+	}
+	return DeployStrategy(uc.Deploy.Strategy)
+}
+
+// validateDeploy checks, that an overlapping deploy can tell, when the new version is ready, and where it listens
+func (uc UnitConfig) validateDeploy() error {
+	if uc.Deploy == nil {
+		return nil
+	}
+	if err := uc.Deploy.Validate(); err != nil {
+		return err
+	}
+	if uc.deployStrategy() != DeployOverlap {
+		return nil
+	}
+	if uc.Health == nil {
+		return errors.Errorf("strategy %q requires a health check", DeployOverlap)
+	}
+	if len(uc.Sockets) == 0 && uc.Deploy.AltPortOffset == 0 {
+		return errors.Errorf("strategy %q requires sockets or an alt-port-offset", DeployOverlap)
+	}
+	if uc.Deploy.AltPortOffset > 0 {
+		if uc.BasePort == 0 {
+			return errors.Errorf("alt-port-offset requires a base-port")
+		}
+		if uc.BasePort+uc.Deploy.AltPortOffset+uc.instances()-1 > 65535 {
+			return errors.Errorf("alt-port-offset %d is out of range", uc.Deploy.AltPortOffset)
+		}
+	}
+	return nil
+}
+
+func (uc UnitConfig) deployHealthyTimeout() time.Duration {
+	if uc.Deploy == nil || uc.Deploy.HealthyTimeoutSec == 0 {
+		return defaultDeployHealthyTimeout
+	}
+	return time.Duration(uc.Deploy.HealthyTimeoutSec) * time.Second
+}
+
+// overlapBlocker returns, why the running instances cus can't be updated to uc with an overlap, or an empty string
+func overlapBlocker(cus []*controllerUnit, uc UnitConfig) string {
+	if uc.deployStrategy() != DeployOverlap {
+		return "strategy is " + string(uc.deployStrategy())
+	}
+	if len(instanceNumbers(uc)) != len(cus) {
+		return "the number of instances changes"
+	}
+	started := false
+	for _, cu := range cus {
+		if !cu.guard.IsStarted() {
+			continue
+		}
+		started = true
+		if len(uc.Sockets) > 0 {
+			scs := newInstanceExpander(uc, cu.instance).expandSockets(uc.Sockets)
+			if !cu.sockets.matches(scs) {
+				return "the sockets change"
+			}
+		}
+	}
+	if !started {
+		return "no instance is running"
+	}
+	return ""
+}
+
+// deployOverlap updates the unit, while the running instances cus keep serving. For every running instance a
+// successor of the new version is started. When all successors are healthy, the old processes are stopped.
+// Otherwise the successors are stopped and the previous version is restored.
+func (c *Controller) deployOverlap(unit string, cus []*controllerUnit, dir string, uc UnitConfig) (resp CommandResponse) {
+	// the program of the old guards is replaced by the new one, so they must not restart during the overlap
+	held := holdRestarts(cus)
+	u, prevDir, err := c.unitConfigs.UpdateKeepPrevious(unit, dir)
+	if err != nil {
+		resumeRestarts(held, &resp)
+		resp.AddError(errors.Wrapf(err, "%q: update-unit-config", unit))
+		return resp
+	}
+	resp.AddMsg("unit %q: updated, starting the new version alongside the running one", unit)
+
+	var successors []*controllerUnit
+	var deployErr error
+	for _, cu := range cus {
+		if !cu.guard.IsStarted() {
+			continue
+		}
+		ncu, err := c.startSuccessor(cu, u)
+		if ncu != nil {
+			successors = append(successors, ncu)
+		}
+		if err != nil {
+			deployErr = err
+			break
+		}
+		resp.AddMsg("started new version of %q with PID %d", ncu.name, ncu.guard.PID())
+	}
+	if deployErr == nil {
+		deployErr = c.waitHealthy(successors, uc.deployHealthyTimeout())
+	}
+	if deployErr != nil {
+		resp.Errorf("unit %q: new version failed: %v", unit, deployErr)
+		for _, ncu := range successors {
+			c.stopSuccessor(ncu)
+		}
+		_, err := c.unitConfigs.Restore(unit, prevDir)
+		if err != nil {
+			resp.Errorf("unit %q: restore previous version: %v", unit, err)
+			return resp
+		}
+		resumeRestarts(held, &resp)
+		resp.AddMsg("unit %q: rolled back, the previous version keeps running", unit)
+		return resp
+	}
+
+	// hand over from the old processes to the successors
+	for _, cu := range cus {
+		var ncu *controllerUnit
+		for _, scu := range successors {
+			if scu.name == cu.name {
+				ncu = scu
+			}
+		}
+		if ncu != nil {
+			// the old guard must not report its stop for the instance anymore
+			cu.guard.UpdateOpts(WithOnChange(func(GuardRunningState, int) {}), WithOnExit(func(ExitInfo) {}), WithOnDesiredChange(func(DesiredState) {}))
+			if cu.guard.IsStarted() {
+				notes, err := cu.guard.StopReport()
+				for _, note := range notes {
+					resp.AddMsg("%s: %s", cu.name, note)
+				}
+				if err != nil {
+					resp.Errorf("stopping old version of %q: %v", cu.name, err)
+				}
+			} else {
+				resp.AddMsg("old version of %q exited during the overlap", cu.name)
+			}
+			cu.cancel()
+			<-cu.guardDoneC
+			c.Lock()
+			c.handOverGuard(cu, ncu)
+			cu.portOffset = ncu.portOffset
+			c.Unlock()
+		}
+		err := c.updateControllerUnit(cu, u, cu.instance)
+		if err != nil {
+			resp.AddError(err)
+			continue
+		}
+		if ncu != nil {
+			pid := cu.guard.PID()
+			c.guardChanged(cu.name, GuardStatusRunningStarted, pid)
+			resp.AddMsg("unit %q: switched to new version with PID %d", cu.name, pid)
+		}
+	}
+	if err := c.unitConfigs.DiscardPrevious(prevDir); err != nil {
+		log.Warnf("controller: %q: %v", unit, err)
+	}
+	return resp
+}
+
+// holdRestarts disables the restarts of the running instances of cus and returns them
+func holdRestarts(cus []*controllerUnit) []*controllerUnit {
+	var held []*controllerUnit
+	for _, cu := range cus {
+		if !cu.guard.IsStarted() {
+			continue
+		}
+		if err := cu.guard.UpdateOpts(WithRestartMode(RestartNever)); err != nil {
+			log.Warnf("controller: %q: hold restarts: %v", cu.name, err)
+		}
+		held = append(held, cu)
+	}
+	return held
+}
+
+// resumeRestarts restores the restart mode of the instances held by holdRestarts. Instances, which exited
+// in the meantime, are started again.
+func resumeRestarts(held []*controllerUnit, resp *CommandResponse) {
+	for _, cu := range held {
+		if err := cu.guard.UpdateOpts(WithRestartMode(cu.unit.Config.restartMode())); err != nil {
+			resp.Errorf("unit %q: resume restarts: %v", cu.name, err)
+			continue
+		}
+		if cu.guard.IsStarted() {
+			continue
+		}
+		pid, err := cu.guard.Start()
+		if err != nil {
+			resp.Errorf("unit %q: start previous version: %v", cu.name, err)
+			continue
+		}
+		resp.AddMsg("unit %q: started previous version with PID %d, as it exited during the overlap", cu.name, pid)
+	}
+}
+
+// startSuccessor starts a guard of the new version u for the running instance cu. The guard doesn't report to the stats yet.
+func (c *Controller) startSuccessor(cu *controllerUnit, u Unit) (*controllerUnit, error) {
+	ncu := &controllerUnit{
+		unit:       u,
+		instance:   cu.instance,
+		name:       cu.name,
+		logs:       cu.logs,
+		cgroup:     cu.cgroup,
+		sockets:    cu.sockets,
+		portOffset: cu.portOffset,
+	}
+	if len(u.Config.Sockets) == 0 {
+		// alternate between the base ports and the ones with offset
+		if cu.portOffset == 0 {
+			ncu.portOffset = u.Config.Deploy.AltPortOffset
+		} else {
+			ncu.portOffset = 0
+		}
+	}
+	ncu.health = c.healthMonitor(ncu)
+	opts := append(c.guardOpts(ncu),
+		WithOnChange(func(GuardRunningState, int) {}), WithOnExit(func(ExitInfo) {}), WithOnDesiredChange(func(DesiredState) {}))
+	guard, err := NewGuard(filepath.Join(u.Dir, u.Config.Program), opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new-guard for new version of %q", cu.name)
+	}
+	ncu.guard = guard
+	c.Lock()
+	c.runGuard(ncu)
+	c.Unlock()
+	_, err = guard.Start()
+	if err != nil {
+		return ncu, errors.Wrapf(err, "start new version of %q", cu.name)
+	}
+	return ncu, nil
+}
+
+func (c *Controller) stopSuccessor(ncu *controllerUnit) {
+	if ncu.guard.IsStarted() {
+		if err := ncu.guard.Stop(); err != nil {
+			log.Errorf("controller: stop new version of %q: %v", ncu.name, err)
+		}
+	}
+	ncu.cancel()
+}
+
+// waitHealthy waits until all successors are healthy. It fails, if one exits or doesn't become healthy in time.
+func (c *Controller) waitHealthy(successors []*controllerUnit, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(c.runCtx, timeout)
+	defer cancel()
+	for _, ncu := range successors {
+		for {
+			if !ncu.guard.IsStarted() {
+				st := ncu.guard.Status()
+				if st.LastExit != nil {
+					return errors.Errorf("%q exited: %s", ncu.name, st.LastExit)
+				}
+				return errors.Errorf("%q is not running", ncu.name)
+			}
+			ncu.health.check(ctx)
+			status, _, _, err := ncu.health.state()
+			if status == HealthHealthy {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return errors.Errorf("%q is not healthy after %s: %v", ncu.name, timeout, err)
+			case <-time.After(overlapProbeInterval):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package copr
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dependencyTimeout      = 30 * time.Second
+	dependencyPollInterval = 100 * time.Millisecond
+)
+
+// unitOrder returns the unit names sorted topologically by their dependencies (depends-on and after).
+// Units without mutual dependencies keep their original order.
+func unitOrder(units []Unit) ([]string, error) {
+	order, broken := partialUnitOrder(units)
+	for _, u := range units {
+		if err, ok := broken[u.Name]; ok {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// partialUnitOrder sorts the units like unitOrder, but leaves out the units with broken dependencies.
+// Those are returned with the reason: an unknown dependency, a cycle or a dependency, which is broken itself.
+func partialUnitOrder(units []Unit) (order []string, broken map[string]error) {
+	index := map[string]int{}
+	for i, u := range units {
+		index[u.Name] = i
+	}
+	broken = map[string]error{}
+	for _, u := range units {
+		for _, dep := range u.Config.DependsOn {
+			if _, ok := index[dep]; !ok {
+				broken[u.Name] = errors.Errorf("unit %q depends on unknown unit %q", u.Name, dep)
+				break
+			}
+		}
+	}
+	// edges from dependency to dependent units
+	dependents := make([][]int, len(units))
+	inDegree := make([]int, len(units))
+	for i, u := range units {
+		for _, dep := range u.Config.DependsOn {
+			di, ok := index[dep]
+			if !ok {
+				continue
+			}
+			dependents[di] = append(dependents[di], i)
+			inDegree[i]++
+		}
+		for _, dep := range u.Config.After {
+			// after is about ordering only - unknown units are ignored
+			di, ok := index[dep]
+			if !ok {
+				continue
+			}
+			dependents[di] = append(dependents[di], i)
+			inDegree[i]++
+		}
+	}
+
+	var ready []int
+	for i := range units {
+		if inDegree[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		i := ready[0]
+		ready = ready[1:]
+		if _, ok := broken[units[i].Name]; !ok {
+			order = append(order, units[i].Name)
+		}
+		for _, di := range dependents[i] {
+			inDegree[di]--
+			if inDegree[di] == 0 {
+				ready = append(ready, di)
+			}
+		}
+	}
+	var cycle []string
+	for i, u := range units {
+		if inDegree[i] > 0 {
+			cycle = append(cycle, u.Name)
+		}
+	}
+	for _, name := range cycle {
+		if _, ok := broken[name]; !ok {
+			broken[name] = errors.Errorf("dependency cycle between units %s", strings.Join(cycle, ", "))
+		}
+	}
+
+	// units depending on broken units are broken as well
+	for changed := true; changed; {
+		changed = false
+		var valid []string
+		for _, name := range order {
+			for _, dep := range units[index[name]].Config.DependsOn {
+				if _, ok := broken[dep]; ok {
+					broken[name] = errors.Errorf("unit %q depends on unit %q with broken dependencies", name, dep)
+					changed = true
+					break
+				}
+			}
+			if _, ok := broken[name]; !ok {
+				valid = append(valid, name)
+			}
+		}
+		order = valid
+	}
+	return order, broken
+}
+
+// dependencyReady checks, if the unit of cu can serve as a dependency.
+// It returns ready=false and no error, if it's worth to wait.
+func dependencyReady(cu *controllerUnit) (ready bool, err error) {
+	if !cu.unit.Config.Enabled {
+		return false, errors.Errorf("unit %q is disabled", cu.name)
+	}
+	switch cu.guard.Status().RunningState {
+	case GuardStatusCompleted:
+		return true, nil
+	case GuardStatusRunningStarted:
+	default:
+		return false, errors.Errorf("unit %q is not started", cu.name)
+	}
+	if cu.health == nil {
+		return true, nil
+	}
+	status, _, _, herr := cu.health.state()
+	switch status {
+	case HealthHealthy:
+		return true, nil
+	case HealthUnhealthy:
+		return false, errors.Errorf("unit %q is unhealthy: %v", cu.name, herr)
+	default:
+		return false, nil
+	}
+}
+
+// dependencyInstances returns the instances of each unit, the unit of cu depends on. It reads them under the controller lock,
+// as the waiting callers run aside the command loop too.
+func (c *Controller) dependencyInstances(cu *controllerUnit) ([][]*controllerUnit, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if err := c.dependencyError(cu.unit.Name); err != nil {
+		return nil, err
+	}
+	var deps [][]*controllerUnit
+	for _, dep := range cu.unit.Config.DependsOn {
+		dcus := c.unitInstances(dep)
+		if len(dcus) == 0 {
+			return nil, errors.Errorf("no such dependency %q", dep)
+		}
+		deps = append(deps, dcus)
+	}
+	return deps, nil
+}
+
+// waitDependencies waits until all instances of all units, the unit of cu depends on, are started or healthy, if they have a health check.
+// It gives up, when ctx is done or cu is stopped meanwhile.
+func (c *Controller) waitDependencies(ctx context.Context, cu *controllerUnit) error {
+	deps, err := c.dependencyInstances(cu)
+	if err != nil {
+		return err
+	}
+	c.RLock()
+	stops := cu.stops
+	c.RUnlock()
+	deadline := time.Now().Add(dependencyTimeout)
+	for i, dcus := range deps {
+		dep := cu.unit.Config.DependsOn[i]
+		for _, dcu := range dcus {
+			for {
+				ready, err := dependencyReady(dcu)
+				if err != nil {
+					return errors.Wrapf(err, "dependency %q", dep)
+				}
+				if ready {
+					break
+				}
+				if time.Now().After(deadline) {
+					return errors.Errorf("dependency %q: timeout in waiting for becoming healthy", dcu.name)
+				}
+				select {
+				case <-ctx.Done():
+					return errors.Errorf("dependency %q: canceled in waiting for becoming healthy", dcu.name)
+				case <-time.After(dependencyPollInterval):
+				}
+				c.RLock()
+				stopped := cu.stops != stops
+				c.RUnlock()
+				if stopped {
+					return errors.Errorf("dependency %q: stopped in waiting for becoming healthy", dcu.name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dependenciesReady checks without waiting, if all instances of all units, the unit of cu depends on, are ready
+func (c *Controller) dependenciesReady(cu *controllerUnit) error {
+	deps, err := c.dependencyInstances(cu)
+	if err != nil {
+		return err
+	}
+	for i, dcus := range deps {
+		dep := cu.unit.Config.DependsOn[i]
+		for _, dcu := range dcus {
+			ready, err := dependencyReady(dcu)
+			if err != nil {
+				return errors.Wrapf(err, "dependency %q", dep)
+			}
+			if !ready {
+				return errors.Errorf("dependency %q is not ready", dcu.name)
+			}
+		}
+	}
+	return nil
+}
+
+// distinctUnits returns the distinct units of all unit instances
+func (c *Controller) distinctUnits() []Unit {
+	var us []Unit
+	seen := map[string]bool{}
+	for _, cu := range c.units {
+		if seen[cu.unit.Name] {
+			continue
+		}
+		seen[cu.unit.Name] = true
+		us = append(us, cu.unit)
+	}
+	return us
+}
+
+// orderedUnits returns the controller units in dependency order. Instances of a unit keep their order.
+// Units with broken dependencies come last, so they are stopped first.
+func (c *Controller) orderedUnits() []*controllerUnit {
+	units := c.distinctUnits()
+	order, broken := partialUnitOrder(units)
+	var cus []*controllerUnit
+	for _, name := range order {
+		cus = append(cus, c.unitInstances(name)...)
+	}
+	for _, u := range units {
+		if _, ok := broken[u.Name]; ok {
+			cus = append(cus, c.unitInstances(u.Name)...)
+		}
+	}
+	return cus
+}
+
+// dependencyError returns, why the dependencies of unit are broken, or nil
+func (c *Controller) dependencyError(unit string) error {
+	_, broken := partialUnitOrder(c.distinctUnits())
+	return broken[unit]
+}
+
+// checkDependencies checks if the dependencies are still valid, if u is added or replaced
+func (c *Controller) checkDependencies(u Unit) error {
+	us := []Unit{}
+	for _, du := range c.distinctUnits() {
+		if du.Name != u.Name {
+			us = append(us, du)
+		}
+	}
+	us = append(us, u)
+	// units, which are broken already, don't prevent the update of another unit
+	_, broken := partialUnitOrder(us)
+	return broken[u.Name]
+}
+
+// dependents returns the names of the units, which depend on unit
+func (c *Controller) dependents(unit string) []string {
+	var names []string
+	for _, u := range c.distinctUnits() {
+		for _, dep := range u.Config.DependsOn {
+			if dep == unit {
+				names = append(names, u.Name)
+				break
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,74 @@
+package copr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnitOrder(t *testing.T) {
+	unit := func(name string, dependsOn []string, after []string) Unit {
+		return Unit{Name: name, Config: UnitConfig{DependsOn: dependsOn, After: after}}
+	}
+	tests := map[string]struct {
+		units   []Unit
+		want    []string
+		wantErr bool
+	}{
+		"no-deps": {
+			units: []Unit{unit("a", nil, nil), unit("b", nil, nil), unit("c", nil, nil)},
+			want:  []string{"a", "b", "c"},
+		},
+		"depends-on": {
+			units: []Unit{unit("api", []string{"db"}, nil), unit("db", nil, nil), unit("web", []string{"api"}, nil)},
+			want:  []string{"db", "api", "web"},
+		},
+		"after": {
+			units: []Unit{unit("a", nil, []string{"b"}), unit("b", nil, nil), unit("c", nil, []string{"unknown"})},
+			want:  []string{"b", "a", "c"},
+		},
+		"unknown-dependency": {
+			units:   []Unit{unit("a", []string{"b"}, nil)},
+			wantErr: true,
+		},
+		"cycle": {
+			units:   []Unit{unit("a", []string{"c"}, nil), unit("b", []string{"a"}, nil), unit("c", nil, []string{"b"}), unit("d", nil, nil)},
+			wantErr: true,
+		},
+		"self": {
+			units:   []Unit{unit("a", []string{"a"}, nil)},
+			wantErr: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			order, err := unitOrder(test.units)
+			if test.wantErr {
+				assertErr(t, err, "unit-order")
+				return
+			}
+			assertNoErr(t, err, "unit-order")
+			assertEqual(t, strings.Join(test.want, ","), strings.Join(order, ","), "order")
+		})
+	}
+}
+
+func TestPartialUnitOrder(t *testing.T) {
+	unit := func(name string, dependsOn []string) Unit {
+		return Unit{Name: name, Config: UnitConfig{DependsOn: dependsOn}}
+	}
+	units := []Unit{
+		unit("db", nil),
+		unit("api", []string{"db", "missing"}),
+		unit("web", []string{"api"}),
+		unit("a", []string{"b"}),
+		unit("b", []string{"a"}),
+		unit("worker", []string{"db"}),
+	}
+	order, broken := partialUnitOrder(units)
+	assertEqual(t, "db,worker", strings.Join(order, ","), "order of valid units")
+	for _, name := range []string{"api", "web", "a", "b"} {
+		_, ok := broken[name]
+		assertEqual(t, true, ok, "broken unit %q", name)
+	}
+	assertEqual(t, 4, len(broken), "broken units")
+}
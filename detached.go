@@ -0,0 +1,241 @@
+package copr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProcessStateFile records the processes of detached units in the workspace, so that they can be adopted after a restart of coprd
+const ProcessStateFile = "copr.state.json"
+
+const (
+	adoptedPollInterval = 500 * time.Millisecond
+	outputTailInterval  = 250 * time.Millisecond
+)
+
+// ProcessIdentity identifies a running process. The start time (in clock ticks since boot) and the executable
+// protect against adopting an unrelated process, which reuses the PID. The executable is the one at the start,
+// so a process, which exec'd another program since, isn't adopted.
+type ProcessIdentity struct {
+	PID       int       `json:"pid"`
+	StartTime uint64    `json:"start-time"`
+	Exe       string    `json:"exe"`
+	StartedAt time.Time `json:"started-at"`
+}
+
+func (id ProcessIdentity) String() string {
+	return fmt.Sprintf("pid=%d, exe=%q, start-time=%d", id.PID, id.Exe, id.StartTime)
+}
+
+func (id ProcessIdentity) matches(oid ProcessIdentity) bool {
+	return id.PID == oid.PID && id.StartTime == oid.StartTime && id.Exe == oid.Exe
+}
+
+// verifyProcess returns an error, if the process id is not running anymore
+func verifyProcess(id ProcessIdentity) error {
+	cid, err := readProcessIdentity(id.PID)
+	if err != nil {
+		return err
+	}
+	if !cid.matches(id) {
+		return errors.Errorf("process %d is not the recorded one (%s)", id.PID, cid)
+	}
+	return nil
+}
+
+// outputFileName returns the name of the file, which a detached instance writes stdout or stderr to
+func outputFileName(stream string, instance int) string {
+	if instance == 0 {
+		return stream + ".out"
+	}
+	return fmt.Sprintf("%s.%d.out", stream, instance)
+}
+
+// processState is the persisted map of instance names to their running processes
+type processState struct {
+	mx      sync.Mutex
+	path    string
+	records map[string]ProcessIdentity
+}
+
+func loadProcessState(path string) (*processState, error) {
+	ps := &processState{
+		path:    path,
+		records: map[string]ProcessIdentity{},
+	}
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %q", path)
+	}
+	err = json.Unmarshal(bs, &ps.records)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %q", path)
+	}
+	return ps, nil
+}
+
+func (ps *processState) record(name string) (ProcessIdentity, bool) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	id, ok := ps.records[name]
+	return id, ok
+}
+
+func (ps *processState) names() []string {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	var names []string
+	for name := range ps.records {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (ps *processState) set(name string, id ProcessIdentity) error {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	ps.records[name] = id
+	return ps.save()
+}
+
+func (ps *processState) remove(name string) error {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	if _, ok := ps.records[name]; !ok {
+		return nil
+	}
+	delete(ps.records, name)
+	return ps.save()
+}
+
+// refresh drops the records of processes, which are gone or whose PID was reused. The recorded executables are
+// kept, as adoption verifies the processes against them.
+func (ps *processState) refresh() error {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	changed := false
+	for name, id := range ps.records {
+		cid, err := readProcessIdentity(id.PID)
+		if err == nil && cid.StartTime == id.StartTime {
+			continue
+		}
+		delete(ps.records, name)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ps.save()
+}
+
+// save writes the records to a temporary file, which then replaces the state file. ps must be locked.
+func (ps *processState) save() error {
+	bs, err := json.MarshalIndent(ps.records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encode process state")
+	}
+	tmp := ps.path + ".tmp"
+	err = os.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "write %q", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, ps.path), "rename %q", tmp)
+}
+
+// outputFiles are the output files of a detached process
+type outputFiles struct {
+	stdout *os.File
+	stderr *os.File
+}
+
+// openOutputFiles truncates and opens the output files for a new process
+func openOutputFiles(stdoutPath, stderrPath string) (*outputFiles, error) {
+	open := func(path string) (*os.File, error) {
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mkdir %q", filepath.Dir(path))
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open %q", path)
+		}
+		return f, nil
+	}
+	stdout, err := open(stdoutPath)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := open(stderrPath)
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	return &outputFiles{stdout: stdout, stderr: stderr}, nil
+}
+
+// close closes the files of the guard. The process keeps its own descriptors.
+func (ofs *outputFiles) close() {
+	ofs.stdout.Close()
+	ofs.stderr.Close()
+}
+
+// outputTailer copies, what a detached process writes to its output file, to w
+type outputTailer struct {
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+// tailOutput starts tailing path at offset. An offset < 0 starts at the end of the file.
+func tailOutput(path string, offset int64, w io.Writer) (*outputTailer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", path)
+	}
+	whence := io.SeekStart
+	if offset < 0 {
+		offset, whence = 0, io.SeekEnd
+	}
+	if _, err := f.Seek(offset, whence); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "seek %q", path)
+	}
+	t := &outputTailer{
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+	}
+	go func() {
+		defer close(t.doneC)
+		defer f.Close()
+		ticker := time.NewTicker(outputTailInterval)
+		defer ticker.Stop()
+		for {
+			io.Copy(w, f)
+			select {
+			case <-t.stopC:
+				// copy, what was written until the stop
+				io.Copy(w, f)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return t, nil
+}
+
+func (t *outputTailer) stop() {
+	if t == nil {
+		return
+	}
+	close(t.stopC)
+	<-t.doneC
+}
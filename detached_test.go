@@ -0,0 +1,115 @@
+package copr
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGuardDetachedAdopt(t *testing.T) {
+	dir := t.TempDir()
+	stdoutPath := filepath.Join(dir, outputFileName("stdout", 0))
+	stderrPath := filepath.Join(dir, outputFileName("stderr", 0))
+	newGuard := func(out *LogRing) *Guard {
+		guard, err := NewGuard(
+			"/bin/sh",
+			WithArgs("-c", "echo started; exec sleep 60"),
+			WithWd(dir),
+			WithStdOut(out),
+			WithKillTimeout(2*adoptedPollInterval),
+			WithDetached(stdoutPath, stderrPath),
+		)
+		assertNoErr(t, err, "new-guard")
+		return guard
+	}
+
+	out := NewLogRing(10)
+	guard := newGuard(out)
+	ctx, cancel := context.WithCancel(context.Background())
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		guard.RunCtx(ctx)
+	}()
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	time.Sleep(2 * outputTailInterval)
+	lines, _ := out.Tail(10)
+	assertEqual(t, "started", lines[len(lines)-1], "tailed output")
+	// the shell has exec'd sleep by now
+	id, err := readProcessIdentity(pid)
+	assertNoErr(t, err, "read identity")
+	id.StartedAt = time.Now()
+
+	// the process survives the guard
+	cancel()
+	<-doneC
+	assertNoErr(t, verifyProcess(id), "process after guard is done")
+
+	guard = newGuard(NewLogRing(10))
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	stale := id
+	stale.StartTime++
+	assertErr(t, guard.Adopt(stale), "adopt process with other start time")
+	assertNoErr(t, guard.Adopt(id), "adopt")
+	assertEqual(t, true, guard.IsStarted(), "started after adopt")
+	assertEqual(t, pid, guard.PID(), "adopted PID")
+	assertErr(t, guard.Adopt(id), "adopt twice")
+
+	assertNoErr(t, guard.Stop(), "stop adopted")
+	assertErr(t, verifyProcess(id), "process after stop")
+}
+
+func TestProcessState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ProcessStateFile)
+	ps, err := loadProcessState(path)
+	assertNoErr(t, err, "load missing state")
+	id := ProcessIdentity{PID: 42, StartTime: 4711, Exe: "/bin/sleep", StartedAt: time.Now().UTC().Round(time.Second)}
+	assertNoErr(t, ps.set("a", id), "set a")
+	assertNoErr(t, ps.set("b#2", id), "set b#2")
+	assertNoErr(t, ps.remove("a"), "remove a")
+
+	ps, err = loadProcessState(path)
+	assertNoErr(t, err, "load state")
+	assertEqual(t, 1, len(ps.names()), "number of records")
+	rec, _ := ps.record("b#2")
+	assertEqual(t, id, rec, "record")
+}
+
+func TestProcessStateRefresh(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	assertNoErr(t, cmd.Start(), "start process")
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	id, err := readProcessIdentity(cmd.Process.Pid)
+	assertNoErr(t, err, "read identity")
+
+	ps, err := loadProcessState(filepath.Join(t.TempDir(), ProcessStateFile))
+	assertNoErr(t, err, "load missing state")
+	assertNoErr(t, ps.set("running", id), "set running")
+	// a process, which runs another executable than recorded, keeps its record and doesn't verify
+	replaced := id
+	replaced.Exe = "/bin/other"
+	assertNoErr(t, ps.set("replaced", replaced), "set replaced")
+	stale := id
+	stale.StartTime++
+	assertNoErr(t, ps.set("stale", stale), "set stale")
+
+	assertNoErr(t, ps.refresh(), "refresh")
+	assertEqual(t, 2, len(ps.names()), "number of records after refresh")
+	rec, ok := ps.record("replaced")
+	assertEqual(t, true, ok, "replaced recorded")
+	assertEqual(t, replaced, rec, "replaced record")
+	assertErr(t, verifyProcess(rec), "verify replaced")
+	rec, _ = ps.record("running")
+	assertNoErr(t, verifyProcess(rec), "verify running")
+	_, ok = ps.record("stale")
+	assertEqual(t, false, ok, "stale recorded")
+}
@@ -1,12 +1,13 @@
 module github.com/mazzegi/copr
 
-go 1.19
+go 1.20
 
 require (
 	github.com/BurntSushi/toml v1.2.0
 	github.com/mazzegi/log v0.0.0-20200601101706-01eae2241ec0
 	github.com/pkg/errors v0.9.1
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
 
@@ -16,5 +17,4 @@ require (
 	github.com/tklauser/go-sysconf v0.3.10 // indirect
 	github.com/tklauser/numcpus v0.4.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
 )
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,6 +15,8 @@ import (
 
 type GuardOption func(g *Guard) error
 
+const defaultKillTimeout = 5 * time.Second
+
 func WithArgs(args ...string) GuardOption {
 	return func(g *Guard) error {
 		g.args = args
@@ -63,6 +66,77 @@ func WithKillTimeout(d time.Duration) GuardOption {
 	}
 }
 
+func WithStopSignal(sig syscall.Signal) GuardOption {
+	return func(g *Guard) error {
+		g.stopSignal = sig
+		return nil
+	}
+}
+
+func WithKillMode(m KillMode) GuardOption {
+	return func(g *Guard) error {
+		switch m {
+		case KillModeProcess, KillModeGroup, KillModeMixed:
+		default:
+			return errors.Errorf("invalid kill mode %q", m)
+		}
+		g.killMode = m
+		return nil
+	}
+}
+
+func WithRLimits(rls ...RLimit) GuardOption {
+	return func(g *Guard) error {
+		g.rlimits = rls
+		return nil
+	}
+}
+
+func WithHooks(hooks Hooks) GuardOption {
+	return func(g *Guard) error {
+		g.hooks = hooks
+		return nil
+	}
+}
+
+// WithCredential runs the process with the ids of cred
+func WithCredential(cred *Credential) GuardOption {
+	return func(g *Guard) error {
+		g.credential = cred
+		return nil
+	}
+}
+
+// WithDetached lets the process outlive the guard and coprd. Its output is written to the files stdoutPath and stderrPath,
+// which are tailed to the stdout and stderr writers of the guard.
+func WithDetached(stdoutPath, stderrPath string) GuardOption {
+	return func(g *Guard) error {
+		g.detached = true
+		g.stdoutPath = stdoutPath
+		g.stderrPath = stderrPath
+		return nil
+	}
+}
+
+// WithListenFiles passes the listen sockets files to the process following the LISTEN_FDS convention
+func WithListenFiles(files []*os.File, names []string) GuardOption {
+	return func(g *Guard) error {
+		if len(files) != len(names) {
+			return errors.Errorf("got %d listen files, but %d names", len(files), len(names))
+		}
+		g.listenFiles = files
+		g.listenNames = names
+		return nil
+	}
+}
+
+func WithCgroup(path string) GuardOption {
+	return func(g *Guard) error {
+		g.cgroup = path
+		return nil
+	}
+}
+
 func WithRestartAfter(d time.Duration) GuardOption {
 	return func(g *Guard) error {
 		g.restartAfter = d
@@ -70,6 +144,32 @@ func WithRestartAfter(d time.Duration) GuardOption {
 	}
 }
 
+func WithRestartMode(m RestartMode) GuardOption {
+	return func(g *Guard) error {
+		switch m {
+		case RestartAlways, RestartOnFailure, RestartNever:
+		default:
+			return errors.Errorf("invalid restart mode %q", m)
+		}
+		g.restartMode = m
+		return nil
+	}
+}
+
+func WithRestartPolicy(p RestartPolicy) GuardOption {
+	return func(g *Guard) error {
+		g.restartPolicy = p
+		return nil
+	}
+}
+
+func WithOnExit(onExit func(ei ExitInfo)) GuardOption {
+	return func(g *Guard) error {
+		g.onExit = onExit
+		return nil
+	}
+}
+
 func WithOnChange(onChange func(rs GuardRunningState, pid int)) GuardOption {
 	return func(g *Guard) error {
 		g.onChange = onChange
@@ -77,21 +177,35 @@ func WithOnChange(onChange func(rs GuardRunningState, pid int)) GuardOption {
 	}
 }
 
+// WithOnDesiredChange is called, when the desired state of the guard changed
+func WithOnDesiredChange(onDesired func(d DesiredState)) GuardOption {
+	return func(g *Guard) error {
+		g.onDesired = onDesired
+		return nil
+	}
+}
+
 func NewGuard(programm string, opts ...GuardOption) (*Guard, error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, errors.Wrap(err, "getwd")
 	}
 	g := &Guard{
-		programm:     programm,
-		wd:           wd,
-		stdIn:        os.Stdin,
-		stdOut:       os.Stdout,
-		stdErr:       os.Stderr,
-		actionC:      make(chan any),
-		killTimeout:  5 * time.Second,
-		restartAfter: 5 * time.Second,
-		onChange:     func(rs GuardRunningState, pid int) {},
+		programm:      programm,
+		wd:            wd,
+		stdIn:         os.Stdin,
+		stdOut:        os.Stdout,
+		stdErr:        os.Stderr,
+		actionC:       make(chan any),
+		killTimeout:   defaultKillTimeout,
+		stopSignal:    syscall.SIGINT,
+		killMode:      KillModeProcess,
+		restartAfter:  5 * time.Second,
+		restartMode:   RestartAlways,
+		restartPolicy: DefaultRestartPolicy(),
+		onChange:      func(rs GuardRunningState, pid int) {},
+		onExit:        func(ei ExitInfo) {},
+		onDesired:     func(d DesiredState) {},
 	}
 	for _, o := range opts {
 		err := o(g)
@@ -99,17 +213,20 @@ func NewGuard(programm string, opts ...GuardOption) (*Guard, error) {
 			return nil, err
 		}
 	}
+	g.status.Desired = DesiredStopped
 	g.changeStatus(GuardStatusNotRunning, -1)
 	return g, nil
 }
 
 type actionStartResult struct {
-	err error
-	pid int
+	err   error
+	pid   int
+	notes []string
 }
 
 type actionStopResult struct {
-	err error
+	err   error
+	notes []string
 }
 
 type actionUpdateOptsResult struct {
@@ -124,55 +241,261 @@ type actionStop struct {
 	resC chan actionStopResult
 }
 
+type actionRestart struct {
+	// auto restarts are skipped, if the process is desired to be stopped
+	auto bool
+	resC chan actionStartResult
+}
+
+type actionAdoptResult struct {
+	err error
+}
+
+type actionAdopt struct {
+	id   ProcessIdentity
+	resC chan actionAdoptResult
+}
+
+type actionSignalResult struct {
+	err error
+	pid int
+}
+
+type actionSignal struct {
+	sig   syscall.Signal
+	group bool
+	resC  chan actionSignalResult
+}
+
 type actionUpdateOpts struct {
 	opts []GuardOption
 	resC chan actionUpdateOptsResult
 }
 
+// KillMode determines which processes are signaled on stop
+type KillMode string
+
+const (
+	// KillModeProcess signals only the main process
+	KillModeProcess KillMode = "process"
+	// KillModeGroup signals the whole process group
+	KillModeGroup KillMode = "group"
+	// KillModeMixed sends the stop signal to the main process and SIGKILL to the whole process group
+	KillModeMixed KillMode = "mixed"
+)
+
 type GuardRunningState string
 
 const (
 	GuardStatusNotRunning     GuardRunningState = "not-running"
 	GuardStatusRunningStopped GuardRunningState = "running-stopped"
 	GuardStatusRunningStarted GuardRunningState = "running-started"
+	GuardStatusCrashLooping   GuardRunningState = "crash-looping"
+	GuardStatusCompleted      GuardRunningState = "completed"
+	GuardStatusFailed         GuardRunningState = "failed"
+)
+
+const maxExitHistory = 10
+
+// ExitInfo describes how a process exited
+type ExitInfo struct {
+	PID      int
+	Code     int
+	Signal   string
+	ExitedAt time.Time
+	Duration time.Duration
+	Error    string
+}
+
+func newExitInfo(pid int, startedAt time.Time, ps *os.ProcessState, err error) ExitInfo {
+	ei := ExitInfo{
+		PID:      pid,
+		Code:     -1,
+		ExitedAt: time.Now().UTC(),
+		Duration: time.Since(startedAt),
+	}
+	if ps != nil {
+		ei.Code = ps.ExitCode()
+		ei.Signal = exitSignal(ps)
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			ei.Error = err.Error()
+		}
+	}
+	return ei
+}
+
+// Success returns true, if the process exited with code 0
+func (ei ExitInfo) Success() bool {
+	return ei.Code == 0 && ei.Signal == "" && ei.Error == ""
+}
+
+func (ei ExitInfo) String() string {
+	var how string
+	switch {
+	case ei.Signal != "":
+		how = fmt.Sprintf("signal=%s", ei.Signal)
+	case ei.Error != "":
+		how = fmt.Sprintf("error=%q", ei.Error)
+	default:
+		how = fmt.Sprintf("code=%d", ei.Code)
+	}
+	return fmt.Sprintf("pid=%d, %s, exitedAt=%s, ran=%s",
+		ei.PID, how, ei.ExitedAt.Local().Format("02.01.2006 15:04:05"), ei.Duration.Round(time.Millisecond))
+}
+
+// DesiredState is the state, which a guard maintains for its process
+type DesiredState string
+
+const (
+	// DesiredRunning keeps the process running and restarts it on every exit
+	DesiredRunning DesiredState = "running"
+	// DesiredStopped keeps the process stopped. It is never started automatically.
+	DesiredStopped DesiredState = "stopped"
+	// DesiredCompleted runs the process until it exits successfully
+	DesiredCompleted DesiredState = "completed"
 )
 
 type GuardState struct {
-	RunningState GuardRunningState
-	PID          int
+	Desired DesiredState
+	// StopRequested is set by an explicit stop and reset by the next explicit start
+	StopRequested bool
+	RunningState  GuardRunningState
+	PID           int
+	StartedAt     time.Time
+	LastExit      *ExitInfo
+	Exits         []ExitInfo
 }
 
 type Guard struct {
-	programm     string
-	args         []string
-	env          []string
-	wd           string
-	stdIn        io.Reader
-	stdOut       io.Writer
-	stdErr       io.Writer
-	actionC      chan any
-	killTimeout  time.Duration
-	restartAfter time.Duration
-	statusMx     sync.RWMutex
-	status       GuardState
-	onChange     func(rs GuardRunningState, pid int)
+	programm      string
+	args          []string
+	env           []string
+	wd            string
+	stdIn         io.Reader
+	stdOut        io.Writer
+	stdErr        io.Writer
+	actionC       chan any
+	killTimeout   time.Duration
+	stopSignal    syscall.Signal
+	killMode      KillMode
+	rlimits       []RLimit
+	cgroup        string
+	credential    *Credential
+	hooks         Hooks
+	detached      bool
+	listenFiles   []*os.File
+	listenNames   []string
+	stdoutPath    string
+	stderrPath    string
+	restartAfter  time.Duration
+	restartMode   RestartMode
+	restartPolicy RestartPolicy
+	// minUptime, startupProbe and startupTimeout are checked by explicit starts
+	minUptime      time.Duration
+	startupProbe   StartupProbe
+	startupTimeout time.Duration
+	statusMx       sync.RWMutex
+	status         GuardState
+	onChange       func(rs GuardRunningState, pid int)
+	onExit         func(ei ExitInfo)
+	onDesired      func(d DesiredState)
 }
 
+// Start starts the process. With startup checks, it waits until the process passed them.
 func (g *Guard) Start() (pid int, err error) {
+	pid, _, err = g.StartReport()
+	return pid, err
+}
+
+// StartReport starts the process like Start and additionally returns notes about the executed hooks
+func (g *Guard) StartReport() (pid int, notes []string, err error) {
 	resC := make(chan actionStartResult)
 	g.actionC <- &actionStart{
 		resC: resC,
 	}
 	res := <-resC
-	return res.pid, res.err
+	return res.pid, res.notes, res.err
 }
 
 func (g *Guard) Stop() error {
+	_, err := g.StopReport()
+	return err
+}
+
+// StopReport stops the process like Stop and additionally returns notes about the executed hooks
+func (g *Guard) StopReport() (notes []string, err error) {
 	resC := make(chan actionStopResult)
 	g.actionC <- &actionStop{
 		resC: resC,
 	}
 	res := <-resC
+	return res.notes, res.err
+}
+
+// Restart stops the process, if it is running, and starts it again
+func (g *Guard) Restart() (pid int, err error) {
+	pid, _, err = g.RestartReport()
+	return pid, err
+}
+
+// RestartReport restarts the process like Restart and additionally returns notes about the executed hooks
+func (g *Guard) RestartReport() (pid int, notes []string, err error) {
+	return g.restart(false)
+}
+
+// ErrRestartSkipped is returned by automatic restarts of a process, which is desired to be stopped
+var ErrRestartSkipped = errors.New("restart skipped, as the process is desired to be stopped")
+
+// AutoRestartReport restarts the process like RestartReport on behalf of the guarding logic, like health checks or
+// watchdogs. Unlike an explicit restart, it doesn't override a stop. Then it returns ErrRestartSkipped.
+func (g *Guard) AutoRestartReport() (pid int, notes []string, err error) {
+	return g.restart(true)
+}
+
+func (g *Guard) restart(auto bool) (pid int, notes []string, err error) {
+	resC := make(chan actionStartResult)
+	g.actionC <- &actionRestart{
+		auto: auto,
+		resC: resC,
+	}
+	res := <-resC
+	return res.pid, res.notes, res.err
+}
+
+// Signal sends sig to the running process and returns its PID
+func (g *Guard) Signal(sig syscall.Signal) (pid int, err error) {
+	resC := make(chan actionSignalResult)
+	g.actionC <- &actionSignal{
+		sig:  sig,
+		resC: resC,
+	}
+	res := <-resC
+	return res.pid, res.err
+}
+
+// SignalGroup sends sig to the process group of the running process and returns its PID
+func (g *Guard) SignalGroup(sig syscall.Signal) (pid int, err error) {
+	resC := make(chan actionSignalResult)
+	g.actionC <- &actionSignal{
+		sig:   sig,
+		group: true,
+		resC:  resC,
+	}
+	res := <-resC
+	return res.pid, res.err
+}
+
+// Adopt supervises the running process id, which was started by a detached guard before.
+// It fails, if the process is not running anymore or the PID was reused by another process.
+func (g *Guard) Adopt(id ProcessIdentity) error {
+	resC := make(chan actionAdoptResult)
+	g.actionC <- &actionAdopt{
+		id:   id,
+		resC: resC,
+	}
+	res := <-resC
 	return res.err
 }
 
@@ -203,18 +526,88 @@ func (g *Guard) changeStatus(rs GuardRunningState, pid int) {
 	}()
 	g.status.RunningState = rs
 	g.status.PID = pid
+	if rs == GuardStatusRunningStarted {
+		g.status.StartedAt = time.Now()
+	}
+}
+
+func (g *Guard) setDesired(d DesiredState) {
+	g.statusMx.Lock()
+	changed := g.status.Desired != d
+	g.status.Desired = d
+	g.statusMx.Unlock()
+	if changed {
+		g.onDesired(d)
+	}
+}
+
+func (g *Guard) setStopRequested(requested bool) {
+	g.statusMx.Lock()
+	defer g.statusMx.Unlock()
+	g.status.StopRequested = requested
+}
+
+// desiredRun is the desired state of a started process, which depends on the restart mode
+func (g *Guard) desiredRun() DesiredState {
+	if g.restartMode == RestartAlways {
+		return DesiredRunning
+	}
+	return DesiredCompleted
+}
+
+// setStartedAt overrides the start time of an adopted process
+func (g *Guard) setStartedAt(t time.Time) {
+	g.statusMx.Lock()
+	defer g.statusMx.Unlock()
+	g.status.StartedAt = t
+}
+
+func (g *Guard) exited(ei ExitInfo) {
+	g.statusMx.Lock()
+	defer func() {
+		g.statusMx.Unlock()
+		g.onExit(ei)
+	}()
+	g.status.LastExit = &ei
+	g.status.Exits = append(g.status.Exits, ei)
+	if len(g.status.Exits) > maxExitHistory {
+		g.status.Exits = g.status.Exits[len(g.status.Exits)-maxExitHistory:]
+	}
 }
 
 func (g *Guard) Status() GuardState {
 	g.statusMx.RLock()
 	defer g.statusMx.RUnlock()
-	return g.status
+	st := g.status
+	st.Exits = append([]ExitInfo{}, g.status.Exits...)
+	return st
 }
 
 func (g *Guard) IsStarted() bool {
 	return g.Status().RunningState == GuardStatusRunningStarted
 }
 
+// IsActive returns true, if the process is started or will be restarted
+func (g *Guard) IsActive() bool {
+	st := g.Status()
+	switch st.RunningState {
+	case GuardStatusRunningStarted:
+		return true
+	case GuardStatusRunningStopped:
+		return st.Desired != DesiredStopped
+	default:
+		return false
+	}
+}
+
+func (g *Guard) IsCompleted() bool {
+	return g.Status().RunningState == GuardStatusCompleted
+}
+
+func (g *Guard) IsCrashLooping() bool {
+	return g.Status().RunningState == GuardStatusCrashLooping
+}
+
 func (g *Guard) PID() int {
 	return g.Status().PID
 }
@@ -224,92 +617,478 @@ func (g *Guard) RunCtx(ctx context.Context) {
 	defer g.changeStatus(GuardStatusNotRunning, -1)
 
 	var pid int = -1
-	exitC := make(chan struct{})
+	var startedAt time.Time
+	exitC := make(chan ExitInfo)
+	// loopDoneC stops sending exits, when the loop is done
+	loopDoneC := make(chan struct{})
+	defer close(loopDoneC)
 	isRunning := func() bool {
 		return pid > -1
 	}
 
+	// stderrTail keeps the last stderr lines of the current process for startup errors
+	var stderrTail *LogRing
+	stdErr := func() io.Writer {
+		if stderrTail == nil {
+			return g.stdErr
+		}
+		return io.MultiWriter(g.stdErr, stderrTail)
+	}
+
+	// tailers copy the output of a detached process
+	var tailers []*outputTailer
+	stopTailers := func() {
+		for _, t := range tailers {
+			t.stop()
+		}
+		tailers = nil
+	}
+	startTailers := func(offset int64) {
+		for _, o := range []struct {
+			path string
+			w    io.Writer
+		}{{g.stdoutPath, g.stdOut}, {g.stderrPath, stdErr()}} {
+			t, err := tailOutput(o.path, offset, o.w)
+			if err != nil {
+				g.logErr("tail output: %v", err)
+				continue
+			}
+			tailers = append(tailers, t)
+		}
+	}
+
+	// desired is the state the loop reconciles the process with. Exits of a process, which is desired to be
+	// stopped, never trigger a restart - neither after a stop nor after a kill, which timed out.
+	desired := DesiredStopped
+	want := func(d DesiredState) {
+		desired = d
+		g.setDesired(d)
+	}
+	restart := time.NewTimer(0)
+	stopTimer(restart)
+	restartPending := false
+	// cancelRestart stops a pending restart and returns true, if there was one
+	cancelRestart := func() bool {
+		stopTimer(restart)
+		pending := restartPending
+		restartPending = false
+		return pending
+	}
+
+	stopped := func(ei ExitInfo) {
+		stopTailers()
+		pid = -1
+		g.exited(ei)
+		g.changeStatus(GuardStatusRunningStopped, -1)
+	}
+
 	kill := func() error {
-		//TODO: use  exec.CommandContext() instead of kill - maybe
 		if !isRunning() {
 			return errors.Errorf("not running")
 		}
-		err := killProcess(pid)
+		// child processes are started with setpgid, so the pgid equals the pid of the main process
+		pgid := pid
+		stopGroup := func(ei ExitInfo) {
+			stopped(ei)
+			if g.killMode == KillModeGroup || g.killMode == KillModeMixed {
+				// kill remaining processes of the group
+				signalGroup(pgid, syscall.SIGKILL)
+			}
+		}
+
+		var err error
+		if g.killMode == KillModeGroup {
+			err = signalGroup(pgid, g.stopSignal)
+		} else {
+			err = signalProcess(pid, g.stopSignal)
+		}
 		if err != nil {
-			return errors.Wrap(err, "kill-process")
+			return errors.Wrapf(err, "signal-process with %s", signalName(g.stopSignal))
 		}
-		pid = -1
-		g.changeStatus(GuardStatusRunningStopped, -1)
 		timer := time.NewTimer(g.killTimeout)
 		defer timer.Stop()
 		select {
-		case <-exitC:
+		case ei := <-exitC:
+			stopGroup(ei)
 			return nil
 		case <-timer.C:
-			return errors.Errorf("kill: timeout in waiting for exit")
+		}
+
+		g.logErr("kill: no exit after %s, escalating to SIGKILL", g.killTimeout)
+		if g.killMode == KillModeProcess {
+			err = signalProcess(pid, syscall.SIGKILL)
+		} else {
+			err = signalGroup(pgid, syscall.SIGKILL)
+		}
+		if err != nil {
+			return errors.Wrap(err, "signal-process with SIGKILL")
+		}
+		timer.Reset(g.killTimeout)
+		select {
+		case ei := <-exitC:
+			stopGroup(ei)
+			return nil
+		case <-timer.C:
+			return errors.Errorf("kill: timeout in waiting for exit after SIGKILL")
 		}
 	}
 
+	// notes collects the outcome of hooks for the current action
+	var notes []string
+	runHook := func(h *Hook) error {
+		note, err := g.runHook(h)
+		if note != "" {
+			notes = append(notes, note)
+		}
+		return err
+	}
+
+	// stop runs the stop hooks around kill. A pending restart is cancelled.
+	stop := func() error {
+		if !isRunning() {
+			want(DesiredStopped)
+			if cancelRestart() {
+				notes = append(notes, "cancelled pending restart")
+				g.changeStatus(GuardStatusRunningStopped, -1)
+				return nil
+			}
+			return errors.Errorf("not running")
+		}
+		if err := runHook(g.hooks.PreStop); err != nil {
+			return err
+		}
+		want(DesiredStopped)
+		err := kill()
+		if err != nil {
+			return err
+		}
+		runHook(g.hooks.PostStop)
+		return nil
+	}
+
 	start := func() error {
 		if isRunning() {
 			return errors.Errorf("already running")
 		}
-		cmd := exec.Command(g.programm, g.args...)
+		if err := runHook(g.hooks.PreStart); err != nil {
+			return err
+		}
+		prg, args := g.programm, g.args
+		if len(g.listenFiles) > 0 {
+			prg, args = "/bin/sh", append([]string{"-c", listenPIDWrapper, g.programm}, g.args...)
+		}
+		cmd := exec.Command(prg, args...)
 		env := os.Environ()
 		cmd.Env = append(env, g.env...)
+		if len(g.listenFiles) > 0 {
+			cmd.Env = append(cmd.Env, listenEnv(g.listenNames)...)
+			cmd.ExtraFiles = g.listenFiles
+		}
+		stderrTail = nil
+		if g.hasStartupCheck() {
+			stderrTail = NewLogRing(startupStderrLines)
+		}
 		cmd.Dir = g.wd
 		cmd.Stdin = g.stdIn
 		cmd.Stdout = g.stdOut
-		cmd.Stderr = g.stdErr
-		cmd.SysProcAttr = sysProcAttrChildProc()
-		err := cmd.Start()
+		cmd.Stderr = stdErr()
+		if g.detached {
+			// a detached process must not depend on pipes to coprd, so it gets no stdin and writes to files
+			outs, err := openOutputFiles(g.stdoutPath, g.stderrPath)
+			if err != nil {
+				return err
+			}
+			defer outs.close()
+			cmd.Stdin = nil
+			cmd.Stdout = outs.stdout
+			cmd.Stderr = outs.stderr
+		}
+		cmd.SysProcAttr = sysProcAttrChildProc(g.detached)
+		if g.credential != nil && !g.credential.isCurrent() {
+			cmd.SysProcAttr.Credential = g.credential.sysCredential()
+		}
+		if g.cgroup != "" {
+			// the process is spawned into the cgroup, so neither it nor its children run outside for a moment
+			cgf, err := openCgroup(g.cgroup)
+			if err != nil {
+				return err
+			}
+			defer cgf.Close()
+			setSysProcAttrCgroup(cmd.SysProcAttr, cgf)
+		}
+		err := startProcess(cmd)
 		if err != nil {
+			if g.credential != nil {
+				return privilegeErr(err, "start-command as %s", g.credential)
+			}
 			return errors.Wrap(err, "start-command")
 		}
 		pid = cmd.Process.Pid
-		go func() {
-			defer func() {
-				exitC <- struct{}{}
-			}()
-			err := cmd.Wait()
-			if err != nil {
-				g.logErr("error in cmd-wait: %v", err)
+		startedAt = time.Now()
+		err = g.setupProcess(pid)
+		if err != nil {
+			cmd.Process.Kill()
+			waitProcess(cmd)
+			pid = -1
+			return err
+		}
+		go func(pid int, startedAt time.Time) {
+			err := waitProcess(cmd)
+			select {
+			case exitC <- newExitInfo(pid, startedAt, cmd.ProcessState, err):
+			case <-loopDoneC:
 			}
-		}()
+		}(pid, startedAt)
+		if g.detached {
+			startTailers(0)
+		}
 		g.changeStatus(GuardStatusRunningStarted, pid)
+		runHook(g.hooks.PostStart)
 		return nil
 	}
 
-	restart := time.NewTimer(0)
-	restart.Stop()
+	// settle waits for the startup checks of a started process. If it exits or doesn't pass the probe in time,
+	// the guard doesn't restart it.
+	settle := func() error {
+		if !isRunning() || !g.hasStartupCheck() {
+			return nil
+		}
+		failed := func(err error) error {
+			want(DesiredStopped)
+			g.changeStatus(GuardStatusFailed, -1)
+			return err
+		}
+		var deadline time.Time
+		if g.startupProbe != nil {
+			deadline = startedAt.Add(g.startupTimeout)
+		}
+		ready := g.startupProbe == nil
+		var probeErr error
+		for {
+			if ready && time.Since(startedAt) >= g.minUptime {
+				return nil
+			}
+			wait := g.minUptime - time.Since(startedAt)
+			if !ready {
+				if time.Now().After(deadline) {
+					kill()
+					return failed(startupError(stderrTail, "not ready after %s: %v", g.startupTimeout, probeErr))
+				}
+				wait = startupProbeInterval
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Errorf("guard stopped during startup")
+			case ei := <-exitC:
+				timer.Stop()
+				stopTailers()
+				pid = -1
+				g.exited(ei)
+				return failed(startupError(stderrTail, "exited during startup: %s", ei))
+			case <-timer.C:
+			}
+			if !ready {
+				probeErr = g.startupProbe(ctx)
+				ready = probeErr == nil
+			}
+		}
+	}
+
+	// adopt supervises a process, which isn't a child of the guard. So its exit is detected by polling.
+	adopt := func(id ProcessIdentity) error {
+		if isRunning() {
+			return errors.Errorf("already running")
+		}
+		if !g.detached {
+			return errors.Errorf("only detached guards can adopt processes")
+		}
+		err := verifyProcess(id)
+		if err != nil {
+			return err
+		}
+		pid = id.PID
+		startedAt = id.StartedAt
+		go func(id ProcessIdentity) {
+			ticker := time.NewTicker(adoptedPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-loopDoneC:
+					return
+				case <-ticker.C:
+				}
+				if verifyProcess(id) == nil {
+					continue
+				}
+				ei := ExitInfo{
+					PID:      id.PID,
+					Code:     -1,
+					ExitedAt: time.Now().UTC(),
+					Duration: time.Since(id.StartedAt),
+					Error:    "adopted process exited with unknown status",
+				}
+				select {
+				case exitC <- ei:
+				case <-loopDoneC:
+				}
+				return
+			}
+		}(id)
+		startTailers(-1)
+		want(g.desiredRun())
+		g.setStopRequested(false)
+		g.changeStatus(GuardStatusRunningStarted, pid)
+		g.setStartedAt(startedAt)
+		return nil
+	}
+
+	tracker := &restartTracker{}
 	g.log("loop")
 	defer g.log("loop done")
 	for {
 		select {
 		case <-ctx.Done():
+			if g.detached && isRunning() {
+				g.log("detach from PID %d", pid)
+				stopTailers()
+				return
+			}
 			kill()
 			return
-		case <-exitC:
+		case ei := <-exitC:
+			if desired == DesiredStopped {
+				stopped(ei)
+				continue
+			}
+			stopTailers()
 			pid = -1
+			g.exited(ei)
+			failed := !ei.Success()
+			if failed {
+				g.logErr("exited: %s", ei)
+			}
+			if !failed && desired == DesiredCompleted {
+				g.log("completed")
+				g.changeStatus(GuardStatusCompleted, -1)
+				continue
+			}
+			if failed && g.restartMode == RestartNever {
+				g.changeStatus(GuardStatusFailed, -1)
+				continue
+			}
+			delay, ok := tracker.next(g.restartPolicy, g.restartAfter, time.Now(), ei.Duration)
+			if !ok {
+				g.logErr("crash-looping: giving up restarting")
+				g.changeStatus(GuardStatusCrashLooping, -1)
+				continue
+			}
 			g.changeStatus(GuardStatusRunningStopped, -1)
-			restart.Reset(g.restartAfter)
+			restart.Reset(delay)
+			restartPending = true
 		case <-restart.C:
+			restartPending = false
+			if desired == DesiredStopped {
+				continue
+			}
+			notes = nil
 			err := start()
 			if err != nil {
 				g.logErr("restart: %v", err)
+				// try again like after an immediate exit
+				delay, ok := tracker.next(g.restartPolicy, g.restartAfter, time.Now(), 0)
+				if !ok {
+					g.logErr("crash-looping: giving up restarting")
+					g.changeStatus(GuardStatusCrashLooping, -1)
+					continue
+				}
+				restart.Reset(delay)
+				restartPending = true
 			}
 		case a := <-g.actionC:
+			notes = nil
 			switch a := a.(type) {
 			case *actionStart:
+				// an explicit start resets backoff and crash-loop state
+				if !isRunning() {
+					cancelRestart()
+					tracker.reset()
+				}
+				want(g.desiredRun())
+				g.setStopRequested(false)
 				err := start()
+				if err == nil {
+					err = settle()
+				}
+				if err != nil && !isRunning() {
+					want(DesiredStopped)
+				}
 				a.resC <- actionStartResult{
-					err: err,
-					pid: pid,
+					err:   err,
+					pid:   pid,
+					notes: notes,
+				}
+			case *actionRestart:
+				if a.auto && (desired == DesiredStopped || g.Status().StopRequested) {
+					a.resC <- actionStartResult{
+						err: ErrRestartSkipped,
+						pid: pid,
+					}
+					continue
+				}
+				cancelRestart()
+				tracker.reset()
+				var err error
+				if isRunning() {
+					err = stop()
+				}
+				// a kill, which timed out, leaves the process desired to run. So its late exit restarts it.
+				want(g.desiredRun())
+				g.setStopRequested(false)
+				if err == nil {
+					err = start()
+				}
+				if err == nil {
+					err = settle()
+				}
+				if err != nil && !isRunning() {
+					want(DesiredStopped)
+				}
+				a.resC <- actionStartResult{
+					err:   err,
+					pid:   pid,
+					notes: notes,
 				}
 			case *actionStop:
-				err := kill()
+				g.setStopRequested(true)
+				err := stop()
 				a.resC <- actionStopResult{
+					err:   err,
+					notes: notes,
+				}
+			case *actionSignal:
+				var err error
+				switch {
+				case !isRunning():
+					err = errors.Errorf("not running")
+				case a.group:
+					// the pgid equals the pid of the main process
+					if err = signalGroup(pid, a.sig); err != nil {
+						err = errors.Wrapf(err, "signal-group with %s", signalName(a.sig))
+					}
+				default:
+					if err = signalProcess(pid, a.sig); err != nil {
+						err = errors.Wrapf(err, "signal-process with %s", signalName(a.sig))
+					}
+				}
+				a.resC <- actionSignalResult{
 					err: err,
+					pid: pid,
+				}
+			case *actionAdopt:
+				a.resC <- actionAdoptResult{
+					err: adopt(a.id),
 				}
 			case *actionUpdateOpts:
 				var err error
@@ -319,6 +1098,10 @@ func (g *Guard) RunCtx(ctx context.Context) {
 						break
 					}
 				}
+				if desired != DesiredStopped {
+					// the restart mode may have changed
+					want(g.desiredRun())
+				}
 				a.resC <- actionUpdateOptsResult{
 					err: err,
 				}
@@ -328,3 +1111,25 @@ func (g *Guard) RunCtx(ctx context.Context) {
 		}
 	}
 }
+
+// setupProcess applies rlimits to a started process.
+// This happens right after the start, so the process runs without them for a very short time.
+func (g *Guard) setupProcess(pid int) error {
+	if len(g.rlimits) > 0 {
+		err := setRLimits(pid, g.rlimits)
+		if err != nil {
+			return errors.Wrap(err, "set-rlimits")
+		}
+	}
+	return nil
+}
+
+// stopTimer stops t and drains its channel, so that it can be safely reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
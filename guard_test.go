@@ -10,6 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -135,3 +139,450 @@ func TestGuard(t *testing.T) {
 
 	fmt.Printf("done\n")
 }
+
+func TestGuardCrashLoop(t *testing.T) {
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exit 1"),
+		WithRestartAfter(50*time.Millisecond),
+		WithRestartPolicy(RestartPolicy{
+			Backoff:     BackoffExponential,
+			Factor:      2,
+			MaxRestarts: 3,
+			Window:      10 * time.Second,
+		}),
+	)
+	assertNoErr(t, err, "new-guard")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wc := make(chan struct{})
+	go func() {
+		defer close(wc)
+		guard.RunCtx(ctx)
+	}()
+
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start")
+
+	// restarts after 50, 100 and 200 ms, then gives up
+	<-time.After(800 * time.Millisecond)
+	assertEqual(t, GuardStatusCrashLooping, guard.Status().RunningState, "status after restarts")
+
+	// an explicit start resets the crash-loop
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start after crash-loop")
+	<-time.After(20 * time.Millisecond)
+	assertEqual(t, true, guard.Status().RunningState != GuardStatusCrashLooping, "status after reset")
+
+	cancel()
+	select {
+	case <-wc:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("guard-exit via ctx failed")
+	}
+}
+
+func TestGuardDesiredState(t *testing.T) {
+	var desired []DesiredState
+	var mx sync.Mutex
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exit 1"),
+		WithRestartAfter(300*time.Millisecond),
+		WithOnDesiredChange(func(d DesiredState) {
+			mx.Lock()
+			defer mx.Unlock()
+			desired = append(desired, d)
+		}),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start")
+	<-time.After(100 * time.Millisecond)
+	st := guard.Status()
+	assertEqual(t, DesiredRunning, st.Desired, "desired after start")
+	assertEqual(t, GuardStatusRunningStopped, st.RunningState, "status with pending restart")
+	assertEqual(t, true, guard.IsActive(), "active with pending restart")
+
+	// a stop cancels the pending restart
+	notes, err := guard.StopReport()
+	assertNoErr(t, err, "guard-stop with pending restart")
+	assertEqual(t, 1, len(notes), "notes of stop")
+	<-time.After(400 * time.Millisecond)
+	st = guard.Status()
+	assertEqual(t, DesiredStopped, st.Desired, "desired after stop")
+	assertEqual(t, 1, len(st.Exits), "exits after stop")
+	assertEqual(t, false, guard.IsActive(), "active after stop")
+	assertErr(t, guard.Stop(), "stop of stopped guard")
+
+	// a process, which shall complete, isn't restarted after success
+	assertNoErr(t, guard.UpdateOpts(WithArgs("-c", "exit 0"), WithRestartMode(RestartOnFailure)), "update-opts")
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start to completion")
+	<-time.After(100 * time.Millisecond)
+	st = guard.Status()
+	assertEqual(t, DesiredCompleted, st.Desired, "desired of run to completion")
+	assertEqual(t, GuardStatusCompleted, st.RunningState, "status after completion")
+	assertEqual(t, false, guard.IsActive(), "active after completion")
+
+	mx.Lock()
+	defer mx.Unlock()
+	assertEqual(t, 3, len(desired), "desired changes")
+}
+
+func TestGuardAutoRestartAfterStop(t *testing.T) {
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exec sleep 60"),
+		WithKillTimeout(500*time.Millisecond),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start")
+	_, _, err = guard.AutoRestartReport()
+	assertNoErr(t, err, "auto restart of running guard")
+	assertEqual(t, true, guard.IsStarted(), "started after auto restart")
+
+	// an automatic restart, which races with a stop, doesn't start the process again
+	for i := 0; i < 5; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			guard.AutoRestartReport()
+		}()
+		assertNoErr(t, guard.Stop(), "guard-stop %d", i)
+		wg.Wait()
+		_, _, err = guard.AutoRestartReport()
+		assertEqual(t, ErrRestartSkipped, err, "auto restart after stop %d", i)
+		st := guard.Status()
+		assertEqual(t, false, guard.IsStarted(), "started after stop %d", i)
+		assertEqual(t, DesiredStopped, st.Desired, "desired after stop %d", i)
+		assertEqual(t, true, st.StopRequested, "stop requested after stop %d", i)
+		_, err = guard.Start()
+		assertNoErr(t, err, "guard-start %d", i)
+	}
+
+	// an explicit restart overrides a stop
+	assertNoErr(t, guard.Stop(), "guard-stop")
+	_, err = guard.Restart()
+	assertNoErr(t, err, "restart after stop")
+	assertEqual(t, true, guard.IsStarted(), "started after explicit restart")
+	assertNoErr(t, guard.Stop(), "guard-stop")
+}
+
+func TestRestartPolicyDelay(t *testing.T) {
+	p := RestartPolicy{
+		Backoff:  BackoffExponential,
+		Factor:   2,
+		MaxDelay: 3 * time.Second,
+	}
+	base := 500 * time.Millisecond
+	for i, want := range []time.Duration{500 * time.Millisecond, 1 * time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		assertEqual(t, want, p.delay(base, i), "delay %d", i)
+	}
+	p.Backoff = BackoffFixed
+	assertEqual(t, base, p.delay(base, 10), "fixed delay")
+}
+
+func TestGuardRestartModes(t *testing.T) {
+	tests := map[string]struct {
+		mode RestartMode
+		cmd  string
+		want GuardRunningState
+	}{
+		"never-success":      {mode: RestartNever, cmd: "exit 0", want: GuardStatusCompleted},
+		"never-failure":      {mode: RestartNever, cmd: "exit 3", want: GuardStatusFailed},
+		"on-failure-success": {mode: RestartOnFailure, cmd: "exit 0", want: GuardStatusCompleted},
+		"on-failure-failure": {mode: RestartOnFailure, cmd: "exit 3", want: GuardStatusRunningStopped},
+		"always-success":     {mode: RestartAlways, cmd: "exit 0", want: GuardStatusRunningStopped},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			guard, err := NewGuard(
+				"/bin/sh",
+				WithArgs("-c", test.cmd),
+				WithRestartMode(test.mode),
+				WithRestartAfter(10*time.Second),
+			)
+			assertNoErr(t, err, "new-guard")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go guard.RunCtx(ctx)
+
+			_, err = guard.Start()
+			assertNoErr(t, err, "guard-start")
+			<-time.After(200 * time.Millisecond)
+			assertEqual(t, test.want, guard.Status().RunningState, "status after exit")
+		})
+	}
+}
+
+func TestGuardExitInfo(t *testing.T) {
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "kill -SEGV $$"),
+		WithRestartMode(RestartNever),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	<-time.After(200 * time.Millisecond)
+
+	st := guard.Status()
+	if st.LastExit == nil {
+		t.Fatalf("no last-exit")
+	}
+	assertEqual(t, pid, st.LastExit.PID, "exit pid")
+	assertEqual(t, "SIGSEGV", st.LastExit.Signal, "exit signal")
+	assertEqual(t, 1, len(st.Exits), "exit history")
+}
+
+func TestGuardStopEscalation(t *testing.T) {
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", `trap "" INT; exec sleep 60`),
+		WithStopSignal(syscall.SIGINT),
+		WithKillTimeout(200*time.Millisecond),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start")
+	<-time.After(100 * time.Millisecond)
+
+	err = guard.Stop()
+	assertNoErr(t, err, "guard-stop")
+	st := guard.Status()
+	assertEqual(t, GuardStatusRunningStopped, st.RunningState, "status after stop")
+	if st.LastExit == nil {
+		t.Fatalf("no last-exit")
+	}
+	assertEqual(t, "SIGKILL", st.LastExit.Signal, "exit signal")
+}
+
+// processAlive returns true, if pid exists and is not a zombie
+func processAlive(pid int) bool {
+	bs, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	_, after, ok := strings.Cut(string(bs), ") ")
+	return ok && !strings.HasPrefix(after, "Z")
+}
+
+func TestGuardKillModes(t *testing.T) {
+	for _, mode := range []KillMode{KillModeGroup, KillModeMixed} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := t.TempDir()
+			pidFile := filepath.Join(dir, "child.pid")
+			guard, err := NewGuard(
+				"/bin/sh",
+				WithArgs("-c", fmt.Sprintf("sleep 60 & echo $! > %s; wait", pidFile)),
+				WithStopSignal(syscall.SIGTERM),
+				WithKillMode(mode),
+				WithKillTimeout(500*time.Millisecond),
+			)
+			assertNoErr(t, err, "new-guard")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go guard.RunCtx(ctx)
+
+			_, err = guard.Start()
+			assertNoErr(t, err, "guard-start")
+			<-time.After(200 * time.Millisecond)
+
+			bs, err := os.ReadFile(pidFile)
+			assertNoErr(t, err, "read pid-file")
+			childPID, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+			assertNoErr(t, err, "parse child pid")
+			assertEqual(t, true, processAlive(childPID), "child alive before stop")
+
+			err = guard.Stop()
+			assertNoErr(t, err, "guard-stop")
+			<-time.After(100 * time.Millisecond)
+			assertEqual(t, false, processAlive(childPID), "child alive after stop")
+		})
+	}
+}
+
+func TestGuardSignal(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "signals.txt")
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", fmt.Sprintf(`(trap 'echo child >> %[1]s' USR1; while true; do sleep 0.05; done) &
+trap 'echo main >> %[1]s' USR1; while true; do sleep 0.05; done`, out)),
+		WithKillMode(KillModeGroup),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, err = guard.Signal(syscall.SIGUSR1)
+	assertErr(t, err, "signal before start")
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	<-time.After(100 * time.Millisecond)
+
+	spid, err := guard.Signal(syscall.SIGUSR1)
+	assertNoErr(t, err, "signal")
+	assertEqual(t, pid, spid, "signaled pid")
+	<-time.After(200 * time.Millisecond)
+	bs, _ := os.ReadFile(out)
+	assertEqual(t, "main\n", string(bs), "signaled processes")
+
+	_, err = guard.SignalGroup(syscall.SIGUSR1)
+	assertNoErr(t, err, "signal-group")
+	<-time.After(200 * time.Millisecond)
+	bs, _ = os.ReadFile(out)
+	assertEqual(t, 3, strings.Count(string(bs), "\n"), "signaled processes of group")
+	assertEqual(t, 2, strings.Count(string(bs), "main"), "signaled main processes of group")
+	assertEqual(t, true, guard.IsStarted(), "started after signals")
+	assertNoErr(t, guard.Stop(), "guard-stop")
+
+	tcs := map[syscall.Signal]bool{
+		syscall.SIGUSR1: true,
+		syscall.SIGHUP:  true,
+		syscall.SIGUSR2: true,
+		syscall.SIGQUIT: false,
+		syscall.SIGTERM: false,
+		syscall.SIGKILL: false,
+	}
+	for sig, ok := range tcs {
+		assertEqual(t, ok, UnitConfig{}.signalAllowed(sig), "allowed signal %s", signalName(sig))
+	}
+	uc := UnitConfig{Program: "run.sh", AllowedSignals: []string{"QUIT", "sigusr1"}}
+	assertNoErr(t, uc.Validate(), "validate allowed-signals")
+	assertEqual(t, true, uc.signalAllowed(syscall.SIGQUIT), "configured signal allowed")
+	assertEqual(t, true, uc.signalAllowed(syscall.SIGUSR1), "configured signal allowed")
+	assertEqual(t, false, uc.signalAllowed(syscall.SIGHUP), "default signal replaced")
+	uc.AllowedSignals = []string{"FOO"}
+	assertErr(t, uc.Validate(), "validate invalid allowed-signals")
+}
+
+func TestGuardRLimits(t *testing.T) {
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exec sleep 60"),
+		WithRLimits(
+			RLimit{Resource: RLimitNoFile, Soft: 100, Hard: 200},
+			RLimit{Resource: RLimitCore, Soft: 0, Hard: 0},
+		),
+		WithKillTimeout(500*time.Millisecond),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	defer guard.Stop()
+
+	rls, err := getRLimits(pid)
+	assertNoErr(t, err, "get-rlimits")
+	for _, rl := range rls {
+		switch rl.Resource {
+		case RLimitNoFile:
+			assertEqual(t, "nofile=100:200", rl.String(), "nofile")
+		case RLimitCore:
+			assertEqual(t, "core=0:0", rl.String(), "core")
+		}
+	}
+}
+
+func TestGuardCredential(t *testing.T) {
+	cred := &Credential{UID: 65534, GID: 65534}
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exec sleep 60"),
+		// the test dir may not be accessible for nobody
+		WithWd("/"),
+		WithCredential(cred),
+		WithKillTimeout(500*time.Millisecond),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	pid, err := guard.Start()
+	if os.Geteuid() != 0 {
+		assertErr(t, err, "guard-start without privileges")
+		return
+	}
+	assertNoErr(t, err, "guard-start")
+	defer guard.Stop()
+
+	fi, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	assertNoErr(t, err, "stat proc dir")
+	st := fi.Sys().(*syscall.Stat_t)
+	assertEqual(t, cred.UID, st.Uid, "uid")
+	assertEqual(t, cred.GID, st.Gid, "gid")
+}
+
+func TestGuardHooks(t *testing.T) {
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hooks.log")
+	hook := func(name string, cmd string) *Hook {
+		return &Hook{Name: name, Command: cmd, Timeout: 500 * time.Millisecond}
+	}
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exec sleep 60"),
+		WithWd(dir),
+		WithEnv("HOOK_LOG="+hookLog),
+		WithKillTimeout(500*time.Millisecond),
+		WithHooks(Hooks{
+			PreStart:  hook("pre-start", `echo pre-start >> "$HOOK_LOG"`),
+			PostStart: hook("post-start", "exit 1"),
+			PreStop:   hook("pre-stop", "echo pre-stop >> hooks.log"),
+			PostStop:  hook("post-stop", "sleep 5"),
+		}),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, notes, err := guard.StartReport()
+	assertNoErr(t, err, "guard-start")
+	assertEqual(t, 2, len(notes), "start notes")
+	assertEqual(t, true, strings.HasPrefix(notes[0], "pre-start hook: ok"), "pre-start note: %s", notes[0])
+	assertEqual(t, true, strings.HasSuffix(notes[1], "continued"), "post-start note: %s", notes[1])
+
+	notes, err = guard.StopReport()
+	assertNoErr(t, err, "guard-stop")
+	assertEqual(t, 2, len(notes), "stop notes")
+	assertEqual(t, true, strings.Contains(notes[1], "timeout"), "post-stop note: %s", notes[1])
+
+	bs, err := os.ReadFile(hookLog)
+	assertNoErr(t, err, "read hook log")
+	assertEqual(t, "pre-start\npre-stop\n", string(bs), "hook log")
+
+	// an aborting pre-start hook prevents the start
+	abort := hook("pre-start", "exit 3")
+	abort.Abort = true
+	assertNoErr(t, guard.UpdateOpts(WithHooks(Hooks{PreStart: abort})), "update-opts")
+	_, notes, err = guard.StartReport()
+	assertErr(t, err, "start with failing pre-start hook")
+	assertEqual(t, 1, len(notes), "abort notes")
+	assertEqual(t, false, guard.IsStarted(), "started after abort")
+}
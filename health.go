@@ -0,0 +1,255 @@
+package copr
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type HealthCheckType string
+
+const (
+	HealthCheckHTTP HealthCheckType = "http"
+	HealthCheckTCP  HealthCheckType = "tcp"
+	HealthCheckExec HealthCheckType = "exec"
+)
+
+type HealthStatus string
+
+const (
+	HealthUnknown   HealthStatus = "unknown"
+	HealthHealthy   HealthStatus = "healthy"
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+const (
+	defaultHealthInterval         = 10 * time.Second
+	defaultHealthTimeout          = 2 * time.Second
+	defaultHealthFailureThreshold = 3
+)
+
+// HealthConfig defines how the health of a unit is checked
+type HealthConfig struct {
+	Type HealthCheckType `json:"type"`
+	// URL is used by http checks
+	URL            string `json:"url,omitempty"`
+	ExpectedStatus int    `json:"expected-status,omitempty"`
+	// Address is used by tcp checks
+	Address string `json:"address,omitempty"`
+	// Command and Args are used by exec checks. A relative command is resolved in the unit dir
+	Command            string   `json:"command,omitempty"`
+	Args               []string `json:"args,omitempty"`
+	IntervalSec        int      `json:"interval-sec,omitempty"`
+	TimeoutSec         int      `json:"timeout-sec,omitempty"`
+	FailureThreshold   int      `json:"failure-threshold,omitempty"`
+	StartPeriodSec     int      `json:"start-period-sec,omitempty"`
+	RestartOnUnhealthy bool     `json:"restart-on-unhealthy,omitempty"`
+}
+
+func (hc HealthConfig) Validate() error {
+	switch hc.Type {
+	case HealthCheckHTTP:
+		if hc.URL == "" {
+			return errors.Errorf("http check needs an url")
+		}
+	case HealthCheckTCP:
+		if hc.Address == "" {
+			return errors.Errorf("tcp check needs an address")
+		}
+	case HealthCheckExec:
+		if hc.Command == "" {
+			return errors.Errorf("exec check needs a command")
+		}
+	default:
+		return errors.Errorf("invalid check type %q", hc.Type)
+	}
+	if hc.IntervalSec < 0 || hc.TimeoutSec < 0 || hc.FailureThreshold < 0 || hc.StartPeriodSec < 0 {
+		return errors.Errorf("values must not be negative")
+	}
+	return nil
+}
+
+func (hc HealthConfig) interval() time.Duration {
+	if hc.IntervalSec == 0 {
+		return defaultHealthInterval
+	}
+	return time.Duration(hc.IntervalSec) * time.Second
+}
+
+func (hc HealthConfig) timeout() time.Duration {
+	if hc.TimeoutSec == 0 {
+		return defaultHealthTimeout
+	}
+	return time.Duration(hc.TimeoutSec) * time.Second
+}
+
+func (hc HealthConfig) failureThreshold() int {
+	if hc.FailureThreshold == 0 {
+		return defaultHealthFailureThreshold
+	}
+	return hc.FailureThreshold
+}
+
+func (hc HealthConfig) startPeriod() time.Duration {
+	return time.Duration(hc.StartPeriodSec) * time.Second
+}
+
+// healthProbe returns nil, if the check succeeded
+type healthProbe func(ctx context.Context) error
+
+// newHealthProbe returns the probe of hc. Exec probes run in dir with the credential cred of the unit, if it is not nil.
+func newHealthProbe(hc HealthConfig, dir string, env []string, cred *Credential) healthProbe {
+	switch hc.Type {
+	case HealthCheckHTTP:
+		return func(ctx context.Context) error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, hc.URL, nil)
+			if err != nil {
+				return errors.Wrapf(err, "new-request %q", hc.URL)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return errors.Wrapf(err, "get %q", hc.URL)
+			}
+			resp.Body.Close()
+			expected := hc.ExpectedStatus
+			if expected == 0 {
+				expected = http.StatusOK
+			}
+			if resp.StatusCode != expected {
+				return errors.Errorf("get %q: status %d, expected %d", hc.URL, resp.StatusCode, expected)
+			}
+			return nil
+		}
+	case HealthCheckTCP:
+		return func(ctx context.Context) error {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", hc.Address)
+			if err != nil {
+				return errors.Wrapf(err, "dial %q", hc.Address)
+			}
+			conn.Close()
+			return nil
+		}
+	case HealthCheckExec:
+		return func(ctx context.Context) error {
+			prg := hc.Command
+			if !filepath.IsAbs(prg) {
+				prg = filepath.Join(dir, prg)
+			}
+			cmd := exec.CommandContext(ctx, prg, hc.Args...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), env...)
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			if cred != nil && !cred.isCurrent() {
+				cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred.sysCredential()}
+			}
+			err := startProcess(cmd)
+			if err != nil && cred != nil {
+				return privilegeErr(err, "exec %q as %s", hc.Command, cred)
+			}
+			if err == nil {
+				err = waitProcess(cmd)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "exec %q: %s", hc.Command, out.String())
+			}
+			return nil
+		}
+	default:
+		return func(ctx context.Context) error {
+			return errors.Errorf("invalid check type %q", hc.Type)
+		}
+	}
+}
+
+// healthMonitor keeps the health state of one unit
+type healthMonitor struct {
+	sync.Mutex
+	cfg       HealthConfig
+	probe     healthProbe
+	lastCheck time.Time
+	checking  bool
+	failures  int
+	status    HealthStatus
+	lastErr   error
+}
+
+func newHealthMonitor(hc HealthConfig, dir string, env []string, cred *Credential) *healthMonitor {
+	return &healthMonitor{
+		cfg:    hc,
+		probe:  newHealthProbe(hc, dir, env, cred),
+		status: HealthUnknown,
+	}
+}
+
+// claim returns true, if a check shall be run for a process started at startedAt. Then the check is marked
+// as running, so that no other check is claimed until it is done.
+func (m *healthMonitor) claim(startedAt time.Time) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.checking {
+		return false
+	}
+	if time.Since(startedAt) < m.cfg.startPeriod() {
+		return false
+	}
+	if time.Since(m.lastCheck) < m.cfg.interval() {
+		return false
+	}
+	m.checking = true
+	return true
+}
+
+// check runs the probe and returns true, if the status changed to unhealthy
+func (m *healthMonitor) check(ctx context.Context) (becameUnhealthy bool) {
+	m.Lock()
+	m.checking = true
+	m.Unlock()
+
+	cctx, cancel := context.WithTimeout(ctx, m.cfg.timeout())
+	err := m.probe(cctx)
+	cancel()
+
+	m.Lock()
+	defer m.Unlock()
+	m.checking = false
+	m.lastCheck = time.Now()
+	m.lastErr = err
+	if err == nil {
+		m.failures = 0
+		m.status = HealthHealthy
+		return false
+	}
+	m.failures++
+	if m.failures >= m.cfg.failureThreshold() && m.status != HealthUnhealthy {
+		m.status = HealthUnhealthy
+		return true
+	}
+	return false
+}
+
+func (m *healthMonitor) reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.failures = 0
+	m.status = HealthUnknown
+	m.lastErr = nil
+	m.lastCheck = time.Time{}
+}
+
+func (m *healthMonitor) state() (status HealthStatus, failures int, checkedAt time.Time, err error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.status, m.failures, m.lastCheck, m.lastErr
+}
@@ -0,0 +1,59 @@
+package copr
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNoErr(t, err, "listen")
+	addr := l.Addr().String()
+
+	m := newHealthMonitor(HealthConfig{
+		Type:             HealthCheckTCP,
+		Address:          addr,
+		FailureThreshold: 2,
+	}, ".", nil, nil)
+
+	ctx := context.Background()
+	assertEqual(t, false, m.check(ctx), "check on open listener")
+	status, _, _, _ := m.state()
+	assertEqual(t, HealthHealthy, status, "status with open listener")
+
+	l.Close()
+	assertEqual(t, false, m.check(ctx), "first failing check")
+	status, failures, _, _ := m.state()
+	assertEqual(t, HealthHealthy, status, "status after first failure")
+	assertEqual(t, 1, failures, "failures after first failure")
+
+	assertEqual(t, true, m.check(ctx), "second failing check")
+	status, _, _, _ = m.state()
+	assertEqual(t, HealthUnhealthy, status, "status after threshold")
+	assertEqual(t, false, m.check(ctx), "still unhealthy")
+
+	m.reset()
+	status, _, _, _ = m.state()
+	assertEqual(t, HealthUnknown, status, "status after reset")
+
+	// a claimed check can't be claimed again, until it is done
+	startedAt := time.Now().Add(-time.Hour)
+	assertEqual(t, true, m.claim(startedAt), "claim due check")
+	assertEqual(t, false, m.claim(startedAt), "claim running check")
+	m.check(ctx)
+	assertEqual(t, false, m.claim(startedAt), "claim check before interval")
+}
+
+func TestHealthExecCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running probes with another credential requires root")
+	}
+	hc := HealthConfig{Type: HealthCheckExec, Command: "/bin/sh", Args: []string{"-c", "test $(id -u) = 65534"}}
+	probe := newHealthProbe(hc, "/", nil, &Credential{UID: 65534, GID: 65534})
+	assertNoErr(t, probe(context.Background()), "probe as nobody")
+	probe = newHealthProbe(hc, "/", nil, nil)
+	assertErr(t, probe(context.Background()), "probe as root")
+}
@@ -0,0 +1,177 @@
+package copr
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+type HookFailure string
+
+const (
+	// HookAbort aborts the start or stop, if the hook fails
+	HookAbort HookFailure = "abort"
+	// HookContinue continues with the start or stop, if the hook fails
+	HookContinue HookFailure = "continue"
+)
+
+// HookConfig configures a shell command, which runs before or after a unit is started or stopped
+type HookConfig struct {
+	Command    string `json:"command"`
+	TimeoutSec int    `json:"timeout-sec,omitempty"`
+	// OnFailure is abort or continue. Pre-start hooks abort by default, all others continue.
+	OnFailure string `json:"on-failure,omitempty"`
+}
+
+// HooksConfig configures the hooks of a unit
+type HooksConfig struct {
+	PreStart  *HookConfig `json:"pre-start,omitempty"`
+	PostStart *HookConfig `json:"post-start,omitempty"`
+	PreStop   *HookConfig `json:"pre-stop,omitempty"`
+	PostStop  *HookConfig `json:"post-stop,omitempty"`
+}
+
+func (hc HookConfig) validate(mayAbort bool) error {
+	if hc.Command == "" {
+		return errors.Errorf("no command")
+	}
+	if hc.TimeoutSec < 0 {
+		return errors.Errorf("timeout-sec must not be negative")
+	}
+	switch HookFailure(hc.OnFailure) {
+	case "", HookContinue:
+	case HookAbort:
+		if !mayAbort {
+			return errors.Errorf("on-failure %q is only supported by pre-start and pre-stop hooks", hc.OnFailure)
+		}
+	default:
+		return errors.Errorf("invalid on-failure %q", hc.OnFailure)
+	}
+	return nil
+}
+
+func (hsc HooksConfig) Validate() error {
+	for _, h := range []struct {
+		name     string
+		hc       *HookConfig
+		mayAbort bool
+	}{
+		{"pre-start", hsc.PreStart, true},
+		{"post-start", hsc.PostStart, false},
+		{"pre-stop", hsc.PreStop, true},
+		{"post-stop", hsc.PostStop, false},
+	} {
+		if h.hc == nil {
+			continue
+		}
+		if err := h.hc.validate(h.mayAbort); err != nil {
+			return errors.Wrap(err, h.name)
+		}
+	}
+	return nil
+}
+
+func (hc *HookConfig) hook(name string, defaultAbort bool, ie instanceExpander) *Hook {
+	if hc == nil {
+		return nil
+	}
+	h := &Hook{
+		Name:    name,
+		Command: ie.expand(hc.Command),
+		Timeout: time.Duration(hc.TimeoutSec) * time.Second,
+		Abort:   defaultAbort,
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHookTimeout
+	}
+	switch HookFailure(hc.OnFailure) {
+	case HookAbort:
+		h.Abort = true
+	case HookContinue:
+		h.Abort = false
+	}
+	return h
+}
+
+func (hsc HooksConfig) hooks(ie instanceExpander) Hooks {
+	return Hooks{
+		PreStart:  hsc.PreStart.hook("pre-start", true, ie),
+		PostStart: hsc.PostStart.hook("post-start", false, ie),
+		PreStop:   hsc.PreStop.hook("pre-stop", false, ie),
+		PostStop:  hsc.PostStop.hook("post-stop", false, ie),
+	}
+}
+
+// Hook is a shell command, which the guard runs with the env and working dir of the process
+type Hook struct {
+	Name    string
+	Command string
+	Timeout time.Duration
+	// Abort aborts the start or stop, if the hook fails
+	Abort bool
+}
+
+// Hooks run around explicit and automatic starts and explicit stops. They don't run, when the guard is shut down.
+type Hooks struct {
+	PreStart  *Hook
+	PostStart *Hook
+	PreStop   *Hook
+	PostStop  *Hook
+}
+
+// runHook runs h and returns a note about the outcome. The error is only returned, if the hook failed and aborts.
+func (g *Guard) runHook(h *Hook) (note string, err error) {
+	if h == nil {
+		return "", nil
+	}
+	start := time.Now()
+	herr := g.execHook(h)
+	took := time.Since(start).Round(time.Millisecond)
+	if herr == nil {
+		g.log("%s hook: ok after %s", h.Name, took)
+		return fmt.Sprintf("%s hook: ok after %s", h.Name, took), nil
+	}
+	if h.Abort {
+		g.logErr("%s hook: failed after %s: %v - aborting", h.Name, took, herr)
+		return fmt.Sprintf("%s hook: failed after %s: %v - aborted", h.Name, took, herr), errors.Wrapf(herr, "%s hook", h.Name)
+	}
+	g.logErr("%s hook: failed after %s: %v - continuing", h.Name, took, herr)
+	return fmt.Sprintf("%s hook: failed after %s: %v - continued", h.Name, took, herr), nil
+}
+
+func (g *Guard) execHook(h *Hook) error {
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), g.env...)
+	cmd.Dir = g.wd
+	cmd.Stdout = g.stdOut
+	cmd.Stderr = g.stdErr
+	// run in an own process group, so that a timed out hook can be killed including its children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if g.credential != nil && !g.credential.isCurrent() {
+		cmd.SysProcAttr.Credential = g.credential.sysCredential()
+	}
+	err := startProcess(cmd)
+	if err != nil {
+		return errors.Wrap(err, "start")
+	}
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- waitProcess(cmd)
+	}()
+	timer := time.NewTimer(h.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-doneC:
+		return err
+	case <-timer.C:
+		signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+		<-doneC
+		return errors.Errorf("timeout after %s", h.Timeout)
+	}
+}
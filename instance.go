@@ -0,0 +1,140 @@
+package copr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// placeholders, which are expanded per instance in args, env, health checks, hooks and sockets
+const (
+	placeholderInstance = "{instance}"
+	placeholderPort     = "{port}"
+)
+
+const instanceSep = "#"
+
+func (uc UnitConfig) instances() int {
+	if uc.Instances < 1 {
+		return 1
+	}
+	return uc.Instances
+}
+
+func (uc UnitConfig) validateInstances() error {
+	if uc.Instances < 0 {
+		return errors.Errorf("instances must not be negative")
+	}
+	if uc.BasePort < 0 || uc.BasePort+uc.instances()-1 > 65535 {
+		return errors.Errorf("base-port %d is out of range for %d instances", uc.BasePort, uc.instances())
+	}
+	if uc.instances() > 1 {
+		for _, sc := range uc.Sockets {
+			if !strings.Contains(sc.Address, placeholderInstance) && !strings.Contains(sc.Address, placeholderPort) {
+				return errors.Errorf("socket address %q must contain %s or %s for multiple instances", sc.Address, placeholderInstance, placeholderPort)
+			}
+		}
+	}
+	if uc.BasePort > 0 {
+		return nil
+	}
+	templated := append(append([]string{}, uc.Args...), uc.Env...)
+	for _, sc := range uc.Sockets {
+		templated = append(templated, sc.Address)
+	}
+	if hc := uc.Health; hc != nil {
+		templated = append(templated, hc.URL, hc.Address)
+		templated = append(templated, hc.Args...)
+	}
+	if hsc := uc.Hooks; hsc != nil {
+		for _, hc := range []*HookConfig{hsc.PreStart, hsc.PostStart, hsc.PreStop, hsc.PostStop} {
+			if hc != nil {
+				templated = append(templated, hc.Command)
+			}
+		}
+	}
+	for _, s := range templated {
+		if strings.Contains(s, placeholderPort) {
+			return errors.Errorf("%q uses %s, but no base-port is configured", s, placeholderPort)
+		}
+	}
+	return nil
+}
+
+// instanceName returns the name of an instance. The instance of a single instance unit has the unit name.
+func instanceName(unit string, instance int) string {
+	if instance == 0 {
+		return unit
+	}
+	return fmt.Sprintf("%s%s%d", unit, instanceSep, instance)
+}
+
+// instanceNumbers returns the instance numbers of a unit. A single instance unit has the instance 0.
+func instanceNumbers(uc UnitConfig) []int {
+	n := uc.instances()
+	if n == 1 {
+		return []int{0}
+	}
+	var is []int
+	for i := 1; i <= n; i++ {
+		is = append(is, i)
+	}
+	return is
+}
+
+// instanceExpander expands the placeholders for an instance
+type instanceExpander struct {
+	instance int
+	port     int
+}
+
+func newInstanceExpander(uc UnitConfig, instance int) instanceExpander {
+	num := instance
+	if num == 0 {
+		num = 1
+	}
+	ie := instanceExpander{instance: num}
+	if uc.BasePort > 0 {
+		ie.port = uc.BasePort + num - 1
+	}
+	return ie
+}
+
+func (ie instanceExpander) expand(s string) string {
+	s = strings.ReplaceAll(s, placeholderInstance, strconv.Itoa(ie.instance))
+	if ie.port > 0 {
+		s = strings.ReplaceAll(s, placeholderPort, strconv.Itoa(ie.port))
+	}
+	return s
+}
+
+func (ie instanceExpander) expandAll(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	es := make([]string, len(ss))
+	for i, s := range ss {
+		es[i] = ie.expand(s)
+	}
+	return es
+}
+
+func (ie instanceExpander) expandSockets(scs []SocketConfig) []SocketConfig {
+	var es []SocketConfig
+	for _, sc := range scs {
+		sc.Address = ie.expand(sc.Address)
+		sc.Name = ie.expand(sc.Name)
+		es = append(es, sc)
+	}
+	return es
+}
+
+func (ie instanceExpander) expandHealth(hc HealthConfig) HealthConfig {
+	hc.URL = ie.expand(hc.URL)
+	hc.Address = ie.expand(hc.Address)
+	hc.Command = ie.expand(hc.Command)
+	hc.Args = ie.expandAll(hc.Args)
+	return hc
+}
@@ -0,0 +1,419 @@
+package copr
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mazzegi/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	logsDir                = "logs"
+	defaultLogMaxSizeMB    = 10
+	defaultLogMaxBackups   = 5
+	logBackupTimeFormat    = "20060102-150405.000"
+	compressedBackupSuffix = ".gz"
+)
+
+// LogConfig configures the log files of a unit
+type LogConfig struct {
+	// Disabled logs to the console of coprd instead of the unit log files
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxSizeMB is the size at which a log file is rotated
+	MaxSizeMB int `json:"max-size-mb,omitempty"`
+	// MaxAgeHours is the age at which a log file is rotated. 0 means no age based rotation
+	MaxAgeHours int `json:"max-age-hours,omitempty"`
+	// Compress compresses rotated files with gzip
+	Compress bool `json:"compress,omitempty"`
+	// MaxBackups is the number of rotated files to keep
+	MaxBackups int `json:"max-backups,omitempty"`
+	// RetainDays is the number of days rotated files are kept. 0 means no age based retention
+	RetainDays int `json:"retain-days,omitempty"`
+}
+
+func (lc LogConfig) Validate() error {
+	if lc.MaxSizeMB < 0 || lc.MaxAgeHours < 0 || lc.MaxBackups < 0 || lc.RetainDays < 0 {
+		return errors.Errorf("values must not be negative")
+	}
+	return nil
+}
+
+func (lc LogConfig) rotateOptions() RotateOptions {
+	opts := RotateOptions{
+		MaxSize:    int64(lc.MaxSizeMB) * mB,
+		MaxAge:     time.Duration(lc.MaxAgeHours) * time.Hour,
+		Compress:   lc.Compress,
+		MaxBackups: lc.MaxBackups,
+		Retain:     time.Duration(lc.RetainDays) * 24 * time.Hour,
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = defaultLogMaxSizeMB * mB
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = defaultLogMaxBackups
+	}
+	return opts
+}
+
+type RotateOptions struct {
+	MaxSize    int64
+	MaxAge     time.Duration
+	Compress   bool
+	MaxBackups int
+	Retain     time.Duration
+}
+
+// RotatingFile is a log file, which is rotated by size and age.
+// Rotated files are renamed to <path>.<timestamp> and optionally compressed.
+type RotatingFile struct {
+	mx       sync.Mutex
+	path     string
+	opts     RotateOptions
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+	// background compression and cleanup are serialized by bgMx
+	bgMx sync.Mutex
+	bgWg sync.WaitGroup
+}
+
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "mkdirall %q", filepath.Dir(path))
+	}
+	rf := &RotatingFile{
+		path: path,
+		opts: opts,
+	}
+	err = rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open %q", rf.path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "stat %q", rf.path)
+	}
+	rf.file = f
+	rf.size = fi.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Path() string {
+	return rf.path
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mx.Lock()
+	defer rf.mx.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.needsRotation(int64(len(p))) {
+		err := rf.rotate()
+		if err != nil {
+			log.Errorf("rotate %q: %v", rf.path, err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) needsRotation(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.opts.MaxSize > 0 && rf.size+n > rf.opts.MaxSize {
+		return true
+	}
+	if rf.opts.MaxAge > 0 && time.Since(rf.openedAt) > rf.opts.MaxAge {
+		return true
+	}
+	return false
+}
+
+// Rotate rotates the file immediately
+func (rf *RotatingFile) Rotate() error {
+	rf.mx.Lock()
+	defer rf.mx.Unlock()
+	if rf.closed {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "close %q", rf.path)
+	}
+	backup := backupPath(rf.path, time.Now())
+	err = os.Rename(rf.path, backup)
+	if err != nil {
+		// try to continue with the current file
+		rf.open()
+		return errors.Wrapf(err, "rename %q to %q", rf.path, backup)
+	}
+	err = rf.open()
+	if err != nil {
+		return err
+	}
+
+	rf.bgWg.Add(1)
+	go func(opts RotateOptions) {
+		defer rf.bgWg.Done()
+		rf.bgMx.Lock()
+		defer rf.bgMx.Unlock()
+		if opts.Compress {
+			err := compressFile(backup)
+			if err != nil {
+				log.Errorf("compress %q: %v", backup, err)
+			}
+		}
+		err := cleanupBackups(rf.path, opts)
+		if err != nil {
+			log.Errorf("cleanup backups of %q: %v", rf.path, err)
+		}
+	}(rf.opts)
+	return nil
+}
+
+// backupPath returns a name for a backup of path, which isn't used by another (maybe compressed) backup yet.
+// Several rotations within the same millisecond get a numbered suffix, which keeps the lexical order.
+func backupPath(path string, t time.Time) string {
+	base := path + "." + t.UTC().Format(logBackupTimeFormat)
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		_, errc := os.Stat(p + compressedBackupSuffix)
+		return err == nil || errc == nil
+	}
+	backup := base
+	for i := 1; exists(backup); i++ {
+		backup = fmt.Sprintf("%s_%03d", base, i)
+	}
+	return backup
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mx.Lock()
+	if rf.closed {
+		rf.mx.Unlock()
+		return nil
+	}
+	rf.closed = true
+	err := rf.file.Close()
+	rf.mx.Unlock()
+	rf.bgWg.Wait()
+	return err
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "open %q", path)
+	}
+	defer src.Close()
+	dstPath := path + compressedBackupSuffix
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return errors.Wrapf(err, "create %q", dstPath)
+	}
+	defer dst.Close()
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err != nil {
+		return errors.Wrapf(err, "gzip %q", path)
+	}
+	err = zw.Close()
+	if err != nil {
+		return errors.Wrapf(err, "close gzip-writer %q", dstPath)
+	}
+	return os.Remove(path)
+}
+
+// backups returns the rotated files of path, oldest first
+func backups(path string) ([]string, error) {
+	dir := filepath.Dir(path)
+	prefix := filepath.Base(path) + "."
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read-dir %q", dir)
+	}
+	var bs []string
+	for _, de := range des {
+		if de.IsDir() || !strings.HasPrefix(de.Name(), prefix) {
+			continue
+		}
+		bs = append(bs, filepath.Join(dir, de.Name()))
+	}
+	// the timestamp format sorts lexically
+	sort.Strings(bs)
+	return bs, nil
+}
+
+func cleanupBackups(path string, opts RotateOptions) error {
+	bs, err := backups(path)
+	if err != nil {
+		return err
+	}
+	for i, b := range bs {
+		remove := opts.MaxBackups > 0 && i < len(bs)-opts.MaxBackups
+		if !remove && opts.Retain > 0 {
+			if fi, err := os.Stat(b); err == nil && time.Since(fi.ModTime()) > opts.Retain {
+				remove = true
+			}
+		}
+		if !remove {
+			continue
+		}
+		err := os.Remove(b)
+		if err != nil {
+			return errors.Wrapf(err, "remove %q", b)
+		}
+	}
+	return nil
+}
+
+// unitLogs are the log sinks of a unit. Output is kept in memory and written to log files,
+// or to the console of coprd, if log files are disabled.
+type unitLogs struct {
+	mx         sync.RWMutex
+	stdout     *RotatingFile
+	stderr     *RotatingFile
+	stdoutRing *LogRing
+	stderrRing *LogRing
+}
+
+func newUnitLogs() *unitLogs {
+	return &unitLogs{
+		stdoutRing: NewLogRing(logRingSize),
+		stderrRing: NewLogRing(logRingSize),
+	}
+}
+
+// logFileName returns the name of the stdout or stderr log file of an instance, like stdout.log or stdout.2.log
+func logFileName(stream string, instance int) string {
+	if instance == 0 {
+		return stream + ".log"
+	}
+	return fmt.Sprintf("%s.%d.log", stream, instance)
+}
+
+// open (re-)opens the log files of the instance in dir. If lc is disabled, no log files are used
+func (ul *unitLogs) open(dir string, instance int, lc LogConfig) error {
+	ul.close()
+	if lc.Disabled {
+		return nil
+	}
+	opts := lc.rotateOptions()
+	stdout, err := OpenRotatingFile(filepath.Join(dir, logsDir, logFileName("stdout", instance)), opts)
+	if err != nil {
+		return errors.Wrap(err, "open stdout log")
+	}
+	stderr, err := OpenRotatingFile(filepath.Join(dir, logsDir, logFileName("stderr", instance)), opts)
+	if err != nil {
+		stdout.Close()
+		return errors.Wrap(err, "open stderr log")
+	}
+	ul.mx.Lock()
+	defer ul.mx.Unlock()
+	ul.stdout = stdout
+	ul.stderr = stderr
+	return nil
+}
+
+func (ul *unitLogs) close() {
+	ul.mx.Lock()
+	defer ul.mx.Unlock()
+	if ul.stdout != nil {
+		ul.stdout.Close()
+		ul.stdout = nil
+	}
+	if ul.stderr != nil {
+		ul.stderr.Close()
+		ul.stderr = nil
+	}
+}
+
+// drop closes the log files and the rings, when the unit is removed. Followers of the logs are done then.
+func (ul *unitLogs) drop() {
+	ul.close()
+	ul.stdoutRing.Close()
+	ul.stderrRing.Close()
+}
+
+// stream returns the ring and the log file path (empty, if disabled) of stdout or stderr
+func (ul *unitLogs) stream(stderr bool) (*LogRing, string) {
+	ul.mx.RLock()
+	defer ul.mx.RUnlock()
+	if stderr {
+		if ul.stderr == nil {
+			return ul.stderrRing, ""
+		}
+		return ul.stderrRing, ul.stderr.Path()
+	}
+	if ul.stdout == nil {
+		return ul.stdoutRing, ""
+	}
+	return ul.stdoutRing, ul.stdout.Path()
+}
+
+func (ul *unitLogs) stdoutWriter() io.Writer {
+	return &logSink{logs: ul, stderr: false}
+}
+
+func (ul *unitLogs) stderrWriter() io.Writer {
+	return &logSink{logs: ul, stderr: true}
+}
+
+// logSink writes to the ring and the current log file of a unit.
+// It never fails, as a failing writer would break the output pipe of the process.
+type logSink struct {
+	logs   *unitLogs
+	stderr bool
+}
+
+func (s *logSink) Write(p []byte) (int, error) {
+	s.logs.mx.RLock()
+	defer s.logs.mx.RUnlock()
+	var err error
+	if s.stderr {
+		s.logs.stderrRing.Write(p)
+		if s.logs.stderr != nil {
+			_, err = s.logs.stderr.Write(p)
+		} else {
+			_, err = os.Stderr.Write(p)
+		}
+	} else {
+		s.logs.stdoutRing.Write(p)
+		if s.logs.stdout != nil {
+			_, err = s.logs.stdout.Write(p)
+		} else {
+			_, err = os.Stdout.Write(p)
+		}
+	}
+	if err != nil {
+		log.Errorf("write log: %v", err)
+	}
+	return len(p), nil
+}
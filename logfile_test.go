@@ -0,0 +1,79 @@
+package copr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "stdout.log")
+	rf, err := OpenRotatingFile(path, RotateOptions{
+		MaxSize:    100,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	assertNoErr(t, err, "open rotating file")
+
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 20; i++ {
+		_, err := rf.Write(line)
+		assertNoErr(t, err, "write line %d", i)
+	}
+	assertNoErr(t, rf.Close(), "close")
+
+	bs, err := os.ReadFile(path)
+	assertNoErr(t, err, "read current file")
+	assertEqual(t, true, len(bs) <= 100, "size of current file")
+
+	bks, err := backups(path)
+	assertNoErr(t, err, "backups")
+	assertEqual(t, 2, len(bks), "number of backups")
+	for _, b := range bks {
+		assertEqual(t, true, strings.HasSuffix(b, compressedBackupSuffix), "backup %q is compressed", b)
+	}
+
+	_, err = rf.Write(line)
+	assertEqual(t, true, err != nil, "write after close")
+}
+
+func TestLogRing(t *testing.T) {
+	lr := NewLogRing(3)
+	lr.Write([]byte("one\ntwo\nthr"))
+	lines, complete := lr.Tail(5)
+	assertEqual(t, "one,two", strings.Join(lines, ","), "tail with partial line")
+	assertEqual(t, false, complete, "complete")
+
+	tail, _, c, cancel := lr.Subscribe(1)
+	defer cancel()
+	assertEqual(t, "two", strings.Join(tail, ","), "subscribe tail")
+	lr.Write([]byte("ee\nfour\n"))
+	assertEqual(t, "three", <-c, "first subscribed line")
+	assertEqual(t, "four", <-c, "second subscribed line")
+
+	lines, complete = lr.Tail(3)
+	assertEqual(t, "two,three,four", strings.Join(lines, ","), "tail after wrap")
+	assertEqual(t, true, complete, "complete after wrap")
+
+	// closing the ring ends the subscriptions
+	lr.Close()
+	_, ok := <-c
+	assertEqual(t, false, ok, "subscription open after close")
+	_, _, c, _ = lr.Subscribe(1)
+	_, ok = <-c
+	assertEqual(t, false, ok, "subscription to closed ring open")
+}
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout.log")
+	err := os.WriteFile(path, []byte("a\nb\nc\nd\n"), 0644)
+	assertNoErr(t, err, "write file")
+	lines, err := tailFile(path, 2)
+	assertNoErr(t, err, "tail-file")
+	assertEqual(t, "c,d", strings.Join(lines, ","), "tail")
+	lines, err = tailFile(path, 10)
+	assertNoErr(t, err, "tail-file")
+	assertEqual(t, "a,b,c,d", strings.Join(lines, ","), "tail all")
+}
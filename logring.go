@@ -0,0 +1,168 @@
+package copr
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	logRingSize          = 1000
+	logRingMaxLineLength = 64 * kB
+	logSubscriberBuffer  = 256
+)
+
+// LogRing keeps the most recent lines written to it and passes new lines to its subscribers
+type LogRing struct {
+	mx      sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+	subs    map[chan string]struct{}
+	closed  bool
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{
+		lines: make([]string, size),
+		subs:  make(map[chan string]struct{}),
+	}
+}
+
+// Write splits p into lines. An incomplete last line is kept until it's completed by subsequent writes.
+func (lr *LogRing) Write(p []byte) (int, error) {
+	lr.mx.Lock()
+	defer lr.mx.Unlock()
+	buf := append(lr.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		lr.add(string(bytes.TrimSuffix(buf[:i], []byte("\r"))))
+		buf = buf[i+1:]
+	}
+	if len(buf) > logRingMaxLineLength {
+		lr.add(string(buf))
+		buf = nil
+	}
+	lr.partial = append([]byte{}, buf...)
+	return len(p), nil
+}
+
+func (lr *LogRing) add(line string) {
+	lr.lines[lr.next] = line
+	lr.next = (lr.next + 1) % len(lr.lines)
+	if lr.next == 0 {
+		lr.full = true
+	}
+	for c := range lr.subs {
+		select {
+		case c <- line:
+		default:
+			// slow subscriber - drop the line rather than blocking the process output
+		}
+	}
+}
+
+func (lr *LogRing) len() int {
+	if lr.full {
+		return len(lr.lines)
+	}
+	return lr.next
+}
+
+func (lr *LogRing) tail(n int) []string {
+	l := lr.len()
+	if n > l || n < 0 {
+		n = l
+	}
+	tl := make([]string, 0, n)
+	for i := lr.next - n; i < lr.next; i++ {
+		tl = append(tl, lr.lines[(i+len(lr.lines))%len(lr.lines)])
+	}
+	return tl
+}
+
+// Tail returns the last n lines. If the ring contains fewer lines, complete is false.
+func (lr *LogRing) Tail(n int) (lines []string, complete bool) {
+	lr.mx.Lock()
+	defer lr.mx.Unlock()
+	return lr.tail(n), lr.len() >= n
+}
+
+// Subscribe returns the last n lines and a channel, which receives all subsequent lines. The channel is closed,
+// when the ring is closed. Cancel must be called, when the subscription isn't used anymore.
+func (lr *LogRing) Subscribe(n int) (lines []string, complete bool, c <-chan string, cancel func()) {
+	lr.mx.Lock()
+	defer lr.mx.Unlock()
+	sc := make(chan string, logSubscriberBuffer)
+	if lr.closed {
+		close(sc)
+		return lr.tail(n), lr.len() >= n, sc, func() {}
+	}
+	lr.subs[sc] = struct{}{}
+	cancel = func() {
+		lr.mx.Lock()
+		defer lr.mx.Unlock()
+		delete(lr.subs, sc)
+	}
+	return lr.tail(n), lr.len() >= n, sc, cancel
+}
+
+// Close ends all subscriptions, as no more lines are written to the ring
+func (lr *LogRing) Close() {
+	lr.mx.Lock()
+	defer lr.mx.Unlock()
+	if lr.closed {
+		return
+	}
+	lr.closed = true
+	for c := range lr.subs {
+		close(c)
+		delete(lr.subs, c)
+	}
+}
+
+// tailFile returns the last n lines of the file at path
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %q", path)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat %q", path)
+	}
+
+	const chunkSize = 64 * kB
+	var buf []byte
+	offset := fi.Size()
+	for offset > 0 && bytes.Count(buf, []byte("\n")) <= n {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		chunk := make([]byte, size)
+		_, err := f.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "read %q", path)
+		}
+		buf = append(chunk, buf...)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
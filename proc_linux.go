@@ -3,15 +3,217 @@
 
 package copr
 
-import "syscall"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 
-func sysProcAttrChildProc() *syscall.SysProcAttr {
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sysProcAttrChildProc returns the attributes of a child process. Unless detached, it is killed, when coprd dies.
+func sysProcAttrChildProc(detached bool) *syscall.SysProcAttr {
+	if detached {
+		return &syscall.SysProcAttr{
+			Setpgid: true,
+		}
+	}
 	return &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGKILL,
 		Setpgid:   true,
 	}
 }
 
-func killProcess(pid int) error {
-	return syscall.Kill(pid, syscall.SIGINT)
+// setSysProcAttrCgroup lets the child process start in the cgroup of the open cgroup dir cgf. This requires Linux 5.7.
+func setSysProcAttrCgroup(attr *syscall.SysProcAttr, cgf *os.File) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cgf.Fd())
+}
+
+// procStat are the fields of /proc/<pid>/stat, which copr uses
+type procStat struct {
+	pid       int
+	comm      string
+	state     string
+	ppid      int
+	pgid      int
+	startTime uint64
+}
+
+func (ps procStat) zombie() bool {
+	return ps.state == "Z" || ps.state == "X"
+}
+
+func readProcStat(pid int) (procStat, error) {
+	bs, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, errors.Wrapf(err, "read stat of process %d", pid)
+	}
+	// the command in parentheses may contain spaces, so the fields are counted after it
+	stat := string(bs)
+	lp, rp := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if lp < 0 || rp < lp {
+		return procStat{}, errors.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(stat[rp+1:])
+	if len(fields) < 20 {
+		return procStat{}, errors.Errorf("invalid stat of process %d", pid)
+	}
+	ps := procStat{
+		pid:   pid,
+		comm:  stat[lp+1 : rp],
+		state: fields[0],
+	}
+	ps.ppid, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, errors.Wrapf(err, "parse ppid of process %d", pid)
+	}
+	ps.pgid, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return procStat{}, errors.Wrapf(err, "parse pgid of process %d", pid)
+	}
+	ps.startTime, err = strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procStat{}, errors.Wrapf(err, "parse start time of process %d", pid)
+	}
+	return ps, nil
+}
+
+// readProcessIdentity reads the identity of the running process pid from /proc. Zombies are not running.
+func readProcessIdentity(pid int) (ProcessIdentity, error) {
+	ps, err := readProcStat(pid)
+	if err != nil {
+		return ProcessIdentity{}, err
+	}
+	if ps.zombie() {
+		return ProcessIdentity{}, errors.Errorf("process %d is a zombie", pid)
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return ProcessIdentity{}, errors.Wrapf(err, "read exe of process %d", pid)
+	}
+	return ProcessIdentity{
+		PID:       pid,
+		StartTime: ps.startTime,
+		Exe:       exe,
+	}, nil
+}
+
+// setChildSubreaper makes coprd the new parent of orphaned descendants
+func setChildSubreaper() error {
+	return errors.Wrap(unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0), "prctl PR_SET_CHILD_SUBREAPER")
+}
+
+// childProcesses returns the stats of the child processes of ppid
+func childProcesses(ppid int) ([]procStat, error) {
+	des, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "read-dir /proc")
+	}
+	var children []procStat
+	for _, de := range des {
+		pid, err := strconv.Atoi(de.Name())
+		if err != nil {
+			continue
+		}
+		ps, err := readProcStat(pid)
+		if err != nil {
+			// the process exited meanwhile
+			continue
+		}
+		if ps.ppid == ppid {
+			children = append(children, ps)
+		}
+	}
+	return children, nil
+}
+
+// reapProcess reaps the exited child pid
+func reapProcess(pid int) (syscall.WaitStatus, error) {
+	var ws syscall.WaitStatus
+	_, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	return ws, err
+}
+
+// waitStatusString describes how a process exited
+func waitStatusString(ws syscall.WaitStatus) string {
+	if ws.Signaled() {
+		return fmt.Sprintf("signal=%s", unix.SignalName(ws.Signal()))
+	}
+	return fmt.Sprintf("code=%d", ws.ExitStatus())
+}
+
+func signalProcess(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
+
+// signalGroup sends sig to all processes of the process group pgid
+func signalGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// parseSignal parses signal names like "SIGTERM", "TERM" or "term"
+func parseSignal(s string) (syscall.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, errors.Errorf("invalid signal %q", s)
+	}
+	return sig, nil
+}
+
+func signalName(sig syscall.Signal) string {
+	return unix.SignalName(sig)
+}
+
+// exitSignal returns the name of the signal which terminated the process or an empty string
+func exitSignal(ps *os.ProcessState) string {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+	return unix.SignalName(ws.Signal())
+}
+
+var rlimitResources = map[string]int{
+	RLimitNoFile: unix.RLIMIT_NOFILE,
+	RLimitAS:     unix.RLIMIT_AS,
+	RLimitCore:   unix.RLIMIT_CORE,
+	RLimitNProc:  unix.RLIMIT_NPROC,
+	RLimitCPU:    unix.RLIMIT_CPU,
+}
+
+// setRLimits applies rls to the running process pid
+func setRLimits(pid int, rls []RLimit) error {
+	for _, rl := range rls {
+		res, ok := rlimitResources[rl.Resource]
+		if !ok {
+			return errors.Errorf("unsupported rlimit %q", rl.Resource)
+		}
+		err := unix.Prlimit(pid, res, &unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}, nil)
+		if err != nil {
+			return errors.Wrapf(err, "prlimit %s", rl)
+		}
+	}
+	return nil
+}
+
+// getRLimits returns the effective limits of the supported resources of process pid
+func getRLimits(pid int) ([]RLimit, error) {
+	var rls []RLimit
+	for _, name := range rlimitNames {
+		var rl unix.Rlimit
+		err := unix.Prlimit(pid, rlimitResources[name], nil, &rl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "prlimit %s", name)
+		}
+		rls = append(rls, RLimit{Resource: name, Soft: rl.Cur, Hard: rl.Max})
+	}
+	return rls, nil
 }
@@ -0,0 +1,118 @@
+package copr
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RestartMode determines if a process is restarted after it exited
+type RestartMode string
+
+const (
+	RestartAlways    RestartMode = "always"
+	RestartOnFailure RestartMode = "on-failure"
+	RestartNever     RestartMode = "never"
+)
+
+type BackoffKind string
+
+const (
+	BackoffFixed       BackoffKind = "fixed"
+	BackoffExponential BackoffKind = "exponential"
+)
+
+const (
+	defaultBackoffFactor     = 2.0
+	defaultMaxBackoffDelay   = 5 * time.Minute
+	defaultRestartResetAfter = 1 * time.Minute
+)
+
+// RestartPolicy controls the delay between automatic restarts and when a guard considers its process crash-looping
+type RestartPolicy struct {
+	Backoff BackoffKind
+	// MaxDelay caps the exponential backoff delay
+	MaxDelay time.Duration
+	// Factor is the multiplier for each consecutive restart (exponential backoff only)
+	Factor float64
+	// Jitter randomizes the delay by +/- Jitter*delay (0..1)
+	Jitter float64
+	// MaxRestarts is the number of automatic restarts allowed within Window, before the guard stops restarting. 0 means unlimited
+	MaxRestarts int
+	// Window is the time span in which restarts are counted. If 0, consecutive restarts are counted
+	Window time.Duration
+	// ResetAfter is the uptime after which a process counts as stable again and the backoff is reset
+	ResetAfter time.Duration
+}
+
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Backoff:    BackoffFixed,
+		Factor:     defaultBackoffFactor,
+		ResetAfter: defaultRestartResetAfter,
+	}
+}
+
+// delay returns the delay before the n-th consecutive restart, starting with 0
+func (p RestartPolicy) delay(base time.Duration, n int) time.Duration {
+	d := base
+	if p.Backoff == BackoffExponential && n > 0 {
+		maxDelay := p.MaxDelay
+		if maxDelay <= 0 {
+			maxDelay = defaultMaxBackoffDelay
+		}
+		factor := p.Factor
+		if factor <= 1 {
+			factor = defaultBackoffFactor
+		}
+		fd := float64(base) * math.Pow(factor, float64(n))
+		if fd > float64(maxDelay) || math.IsInf(fd, 0) {
+			fd = float64(maxDelay)
+		}
+		d = time.Duration(fd)
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// restartTracker keeps track of automatic restarts according to a policy
+type restartTracker struct {
+	attempt  int
+	restarts []time.Time
+}
+
+func (t *restartTracker) reset() {
+	t.attempt = 0
+	t.restarts = nil
+}
+
+// next registers an exit after uptime and returns the delay for the next restart.
+// If ok is false, the restart limit is exceeded and the process shall not be restarted.
+func (t *restartTracker) next(p RestartPolicy, base time.Duration, now time.Time, uptime time.Duration) (d time.Duration, ok bool) {
+	if p.ResetAfter > 0 && uptime >= p.ResetAfter {
+		t.attempt = 0
+	}
+	if p.Window > 0 {
+		var inWindow []time.Time
+		for _, rt := range t.restarts {
+			if now.Sub(rt) < p.Window {
+				inWindow = append(inWindow, rt)
+			}
+		}
+		t.restarts = inWindow
+	} else if t.attempt == 0 {
+		t.restarts = nil
+	}
+	if p.MaxRestarts > 0 && len(t.restarts) >= p.MaxRestarts {
+		return 0, false
+	}
+	d = p.delay(base, t.attempt)
+	t.attempt++
+	t.restarts = append(t.restarts, now)
+	return d, true
+}
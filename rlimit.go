@@ -0,0 +1,114 @@
+package copr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const RLimitInfinity = ^uint64(0)
+
+// resource names of the supported rlimits
+const (
+	RLimitNoFile = "nofile"
+	RLimitAS     = "as"
+	RLimitCore   = "core"
+	RLimitNProc  = "nproc"
+	RLimitCPU    = "cpu"
+)
+
+var rlimitNames = []string{RLimitNoFile, RLimitAS, RLimitCore, RLimitNProc, RLimitCPU}
+
+// RLimit is a resource limit of a process
+type RLimit struct {
+	Resource string
+	Soft     uint64
+	Hard     uint64
+}
+
+func rlimitValueString(v uint64) string {
+	if v == RLimitInfinity {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+func (rl RLimit) String() string {
+	return fmt.Sprintf("%s=%s:%s", rl.Resource, rlimitValueString(rl.Soft), rlimitValueString(rl.Hard))
+}
+
+func rlimitsString(rls []RLimit) string {
+	var sl []string
+	for _, rl := range rls {
+		sl = append(sl, rl.String())
+	}
+	return strings.Join(sl, ", ")
+}
+
+// RLimitValue is a limit, which is either a number or "unlimited" in json
+type RLimitValue uint64
+
+func (v RLimitValue) MarshalJSON() ([]byte, error) {
+	if uint64(v) == RLimitInfinity {
+		return json.Marshal("unlimited")
+	}
+	return json.Marshal(uint64(v))
+}
+
+func (v *RLimitValue) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err == nil {
+		if s != "unlimited" {
+			return errors.Errorf("invalid rlimit value %q", s)
+		}
+		*v = RLimitValue(RLimitInfinity)
+		return nil
+	}
+	var n uint64
+	if err := json.Unmarshal(bs, &n); err != nil {
+		return errors.Errorf("invalid rlimit value %s", string(bs))
+	}
+	*v = RLimitValue(n)
+	return nil
+}
+
+type RLimitConfig struct {
+	Soft RLimitValue `json:"soft"`
+	Hard RLimitValue `json:"hard"`
+}
+
+// RLimitsConfig configures the resource limits of a unit process
+type RLimitsConfig struct {
+	NoFile *RLimitConfig `json:"nofile,omitempty"`
+	AS     *RLimitConfig `json:"as,omitempty"`
+	Core   *RLimitConfig `json:"core,omitempty"`
+	NProc  *RLimitConfig `json:"nproc,omitempty"`
+	CPU    *RLimitConfig `json:"cpu,omitempty"`
+}
+
+func (rc RLimitsConfig) rlimits() []RLimit {
+	var rls []RLimit
+	add := func(name string, c *RLimitConfig) {
+		if c == nil {
+			return
+		}
+		rls = append(rls, RLimit{Resource: name, Soft: uint64(c.Soft), Hard: uint64(c.Hard)})
+	}
+	add(RLimitNoFile, rc.NoFile)
+	add(RLimitAS, rc.AS)
+	add(RLimitCore, rc.Core)
+	add(RLimitNProc, rc.NProc)
+	add(RLimitCPU, rc.CPU)
+	return rls
+}
+
+func (rc RLimitsConfig) Validate() error {
+	for _, rl := range rc.rlimits() {
+		if rl.Soft > rl.Hard {
+			return errors.Errorf("%s: soft limit %s exceeds hard limit %s", rl.Resource, rlimitValueString(rl.Soft), rlimitValueString(rl.Hard))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package copr
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mazzegi/log"
+)
+
+type ScheduleOverlap string
+
+const (
+	// ScheduleSkip skips a run, if the previous one is still running
+	ScheduleSkip ScheduleOverlap = "skip"
+	// ScheduleQueue starts a run as soon as the previous one exited. At most one run is queued.
+	ScheduleQueue ScheduleOverlap = "queue"
+)
+
+// unitSchedule tracks the runs of a scheduled unit
+type unitSchedule struct {
+	cron    *CronSchedule
+	overlap ScheduleOverlap
+	next    time.Time
+	queued  bool
+}
+
+// newUnitSchedule returns the schedule of the unit or nil, if the unit isn't scheduled
+func newUnitSchedule(uc UnitConfig, now time.Time) *unitSchedule {
+	if uc.Schedule == "" {
+		return nil
+	}
+	// the schedule is validated with the unit config
+	cs, err := ParseCronSchedule(uc.Schedule)
+	if err != nil {
+		log.Errorf("parse schedule %q: %v", uc.Schedule, err)
+		return nil
+	}
+	overlap := ScheduleOverlap(uc.ScheduleOverlap)
+	if overlap == "" {
+		overlap = ScheduleSkip
+	}
+	return &unitSchedule{
+		cron:    cs,
+		overlap: overlap,
+		next:    cs.Next(now),
+	}
+}
+
+// scheduleResult describes the outcome of a run
+func scheduleResult(ei ExitInfo) string {
+	if ei.Success() {
+		return fmt.Sprintf("success after %s", ei.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("failure (%s)", ei)
+}
+
+func (c *Controller) runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// starts may wait for the startup checks, so they happen without holding the lock
+			var starts []*controllerUnit
+			c.RLock()
+			for _, cu := range c.units {
+				if cu.schedule == nil {
+					continue
+				}
+				if c.tickSchedule(cu, now) {
+					starts = append(starts, cu)
+				}
+			}
+			c.RUnlock()
+			for _, cu := range starts {
+				c.startScheduled(cu, now)
+			}
+		}
+	}
+}
+
+// tickSchedule advances the schedule of the unit and returns true, if a run is due or queued and shall be started
+func (c *Controller) tickSchedule(cu *controllerUnit, now time.Time) bool {
+	s := cu.schedule
+	name := cu.name
+	due := !s.next.IsZero() && !now.Before(s.next)
+	if due {
+		s.next = s.cron.Next(now)
+		c.statCache.scheduleNext(name, s.next)
+	}
+	if !due && !s.queued {
+		return false
+	}
+	if !cu.unit.Config.Enabled {
+		s.queued = false
+		return false
+	}
+	if cu.guard.IsStarted() {
+		if !due {
+			return false
+		}
+		switch s.overlap {
+		case ScheduleQueue:
+			log.Infof("controller: scheduled run of %q is queued, as the previous run is still running", name)
+			s.queued = true
+		default:
+			log.Warnf("controller: skip scheduled run of %q, as the previous run is still running", name)
+			c.statCache.scheduleSkipped(name)
+		}
+		return false
+	}
+	s.queued = false
+	return true
+}
+
+// startScheduled starts a scheduled run of the unit, which was returned by tickSchedule
+func (c *Controller) startScheduled(cu *controllerUnit, now time.Time) {
+	name := cu.name
+	if err := c.dependenciesReady(cu); err != nil {
+		log.Errorf("controller: not starting scheduled run of %q: %v", name, err)
+		c.statCache.scheduleRun(name, now, fmt.Sprintf("not started: %v", err))
+		return
+	}
+	// a short run may exit and record its result, before start returns
+	c.statCache.scheduleRun(name, now, "running")
+	pid, err := cu.guard.Start()
+	if err != nil {
+		log.Errorf("controller: start scheduled run of %q: %v", name, err)
+		c.statCache.scheduleResult(name, fmt.Sprintf("not started: %v", err))
+		return
+	}
+	log.Infof("controller: started scheduled run of %q with PID %d", name, pid)
+}
@@ -0,0 +1,59 @@
+package copr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTickSchedule(t *testing.T) {
+	for _, overlap := range []ScheduleOverlap{ScheduleSkip, ScheduleQueue} {
+		t.Run(string(overlap), func(t *testing.T) {
+			guard, err := NewGuard(
+				"/bin/sh",
+				WithArgs("-c", "sleep 0.3"),
+				WithRestartMode(RestartNever),
+			)
+			assertNoErr(t, err, "new-guard")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go guard.RunCtx(ctx)
+
+			uc := UnitConfig{Enabled: true, Program: "sh", Schedule: "* * * * *", ScheduleOverlap: string(overlap)}
+			c := &Controller{statCache: NewUnitStatsCache()}
+			c.statCache.add("job", true)
+			now := time.Now()
+			cu := &controllerUnit{
+				unit:     Unit{Name: "job", Config: uc},
+				name:     "job",
+				guard:    guard,
+				schedule: newUnitSchedule(uc, now),
+			}
+
+			tick := func(now time.Time) {
+				if c.tickSchedule(cu, now) {
+					c.startScheduled(cu, now)
+				}
+			}
+
+			tick(now)
+			assertEqual(t, false, guard.IsStarted(), "started before due")
+
+			due := cu.schedule.next
+			tick(due)
+			assertEqual(t, true, guard.IsStarted(), "started when due")
+			assertEqual(t, due.Add(time.Minute), cu.schedule.next, "next run")
+
+			// the next tick overlaps with the running one
+			tick(cu.schedule.next)
+			sd, _ := c.statCache.statsDescriptor("job")
+			assertEqual(t, overlap == ScheduleQueue, cu.schedule.queued, "queued")
+			assertEqual(t, overlap == ScheduleSkip, sd.SkippedRuns == 1, "skipped")
+
+			time.Sleep(500 * time.Millisecond)
+			assertEqual(t, false, guard.IsStarted(), "run completed")
+			tick(cu.schedule.next.Add(-time.Second))
+			assertEqual(t, overlap == ScheduleQueue, guard.IsStarted(), "queued run started")
+		})
+	}
+}
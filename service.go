@@ -8,7 +8,9 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +22,7 @@ import (
 type CTLResponse struct {
 	CtrlMessages []string `json:"ctrl-message,omitempty"`
 	CtrlErrors   []string `json:"ctrl-errors,omitempty"`
+	CtrlData     any      `json:"ctrl-data,omitempty"`
 }
 
 func NewService(bind string, controller *Controller, apiKey string) (*Service, error) {
@@ -78,6 +81,7 @@ func (s *Service) replyMsg(w http.ResponseWriter, status int, resp CommandRespon
 	json.NewEncoder(w).Encode(CTLResponse{
 		CtrlMessages: resp.Messages,
 		CtrlErrors:   resp.ErrorStrings(),
+		CtrlData:     resp.Data,
 	})
 }
 
@@ -115,6 +119,8 @@ func (s *Service) handleGET(w http.ResponseWriter, r *http.Request) {
 			resp = s.controller.Stat(unit)
 		}
 		s.replyMsg(w, http.StatusOK, resp)
+	case "logs":
+		s.streamLogs(w, r)
 	default:
 		resp := CommandResponse{}
 		resp.Errorf("no such resource %q", elt)
@@ -145,6 +151,48 @@ func (s *Service) handlePOST(w http.ResponseWriter, r *http.Request) {
 	case "disable":
 		resp := s.controller.Disable(r.URL.Query().Get("unit"))
 		s.replyMsg(w, http.StatusOK, resp)
+	case "restart":
+		resp := s.controller.Restart(r.URL.Query().Get("unit"))
+		s.replyMsg(w, http.StatusOK, resp)
+	case "restart-all":
+		opts, err := restartAllOptions(r.URL.Query())
+		if err != nil {
+			resp := CommandResponse{}
+			resp.AddError(err)
+			s.replyMsg(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp := s.controller.RestartAll(opts)
+		s.replyMsg(w, http.StatusOK, resp)
+	case "reload":
+		resp := s.controller.Reload(r.URL.Query().Get("unit"))
+		s.replyMsg(w, http.StatusOK, resp)
+	case "remove":
+		q := r.URL.Query()
+		keepArchive := true
+		if v := q.Get("keep-archive"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				resp := CommandResponse{}
+				resp.Errorf("invalid keep-archive %q", v)
+				s.replyMsg(w, http.StatusBadRequest, resp)
+				return
+			}
+			keepArchive = b
+		}
+		resp := s.controller.Remove(q.Get("unit"), keepArchive)
+		s.replyMsg(w, http.StatusOK, resp)
+	case "signal":
+		q := r.URL.Query()
+		sig, err := parseSignal(q.Get("sig"))
+		if err != nil {
+			resp := CommandResponse{}
+			resp.AddError(err)
+			s.replyMsg(w, http.StatusBadRequest, resp)
+			return
+		}
+		resp := s.controller.Signal(q.Get("unit"), sig, q.Get("group") == "true")
+		s.replyMsg(w, http.StatusOK, resp)
 	case "deploy":
 		resp, err := s.deploy(r)
 		if err != nil {
@@ -161,8 +209,122 @@ func (s *Service) handlePOST(w http.ResponseWriter, r *http.Request) {
 	_ = tail
 }
 
+const defaultRestartHealthTimeout = 60 * time.Second
+
+// restartAllOptions reads the options of a rolling restart from the query parameters parallel, pause, wait-healthy and health-timeout
+func restartAllOptions(q url.Values) (RestartAllOptions, error) {
+	opts := RestartAllOptions{
+		Parallel:      1,
+		HealthTimeout: defaultRestartHealthTimeout,
+	}
+	if v := q.Get("parallel"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, errors.Errorf("invalid parallel %q", v)
+		}
+		opts.Parallel = n
+	}
+	if v := q.Get("pause"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, errors.Errorf("invalid pause %q", v)
+		}
+		opts.Pause = d
+	}
+	opts.WaitHealthy = q.Get("wait-healthy") == "true"
+	if v := q.Get("health-timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, errors.Errorf("invalid health-timeout %q", v)
+		}
+		opts.HealthTimeout = d
+	}
+	return opts, nil
+}
+
 //
 
+const defaultLogTail = 100
+
+// streamLogs writes the last lines of a units log as plain text. With follow, subsequent lines are streamed until the client disconnects.
+func (s *Service) streamLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tail := defaultLogTail
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			resp := CommandResponse{}
+			resp.Errorf("invalid tail %q", v)
+			s.replyMsg(w, http.StatusBadRequest, resp)
+			return
+		}
+		tail = n
+	}
+	follow := q.Get("follow") == "true"
+	stderr := q.Get("stream") == "stderr"
+
+	ring, path, err := s.controller.UnitLogs(q.Get("unit"), stderr)
+	if err != nil {
+		resp := CommandResponse{}
+		resp.AddError(err)
+		s.replyMsg(w, http.StatusNotFound, resp)
+		return
+	}
+
+	var lines []string
+	var complete bool
+	var lineC <-chan string
+	if follow {
+		var cancel func()
+		lines, complete, lineC, cancel = ring.Subscribe(tail)
+		defer cancel()
+	} else {
+		lines, complete = ring.Tail(tail)
+	}
+	if !complete && path != "" {
+		// the ring doesn't reach back far enough - use the log file, which also contains the lines of the ring.
+		// Lines written in between reading the file and subscribing may be repeated.
+		flines, err := tailFile(path, tail)
+		if err != nil {
+			log.Warnf("tail log file %q: %v", path, err)
+		} else {
+			lines = flines
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if !follow {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case l, ok := <-lineC:
+			if !ok {
+				// the unit was removed
+				return
+			}
+			_, err := fmt.Fprintln(w, l)
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
 func (s *Service) deploy(r *http.Request) (CommandResponse, error) {
 	//copy content to temp file
 	name := fmt.Sprintf("deploy_%s_%d", time.Now().Format("20060102150405"), rand.Intn(1000))
@@ -0,0 +1,239 @@
+package copr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mazzegi/log"
+	"github.com/pkg/errors"
+)
+
+// listenPIDWrapper sets LISTEN_PID to the pid of the process, which then execs the program. So LISTEN_PID equals the pid of the program.
+const listenPIDWrapper = `LISTEN_PID=$$ exec "$0" "$@"`
+
+const socketPollInterval = 500 * time.Millisecond
+
+// SocketConfig configures a listen socket, which coprd opens and passes to the unit as an inherited file descriptor
+type SocketConfig struct {
+	// Network is tcp or unix
+	Network string `json:"network"`
+	// Address is host:port for tcp or the socket path for unix. Relative paths are relative to the unit dir.
+	Address string `json:"address"`
+	// Name is passed in LISTEN_FDNAMES. It defaults to the network and the address.
+	Name string `json:"name,omitempty"`
+}
+
+func (sc SocketConfig) Validate() error {
+	switch sc.Network {
+	case "tcp", "unix":
+	default:
+		return errors.Errorf("invalid network %q", sc.Network)
+	}
+	if sc.Address == "" {
+		return errors.Errorf("no address")
+	}
+	if strings.Contains(sc.Name, ":") {
+		return errors.Errorf("name %q must not contain ':'", sc.Name)
+	}
+	return nil
+}
+
+func (sc SocketConfig) String() string {
+	return fmt.Sprintf("%s:%s", sc.Network, sc.Address)
+}
+
+func (sc SocketConfig) name() string {
+	if sc.Name != "" {
+		return sc.Name
+	}
+	return strings.ReplaceAll(sc.String(), ":", "-")
+}
+
+// unitSockets are the open listen sockets of a unit instance
+type unitSockets struct {
+	configs []SocketConfig
+	files   []*os.File
+}
+
+// openSockets opens the listen sockets scs. Unix socket paths are relative to dir.
+func openSockets(dir string, scs []SocketConfig) (*unitSockets, error) {
+	us := &unitSockets{}
+	for _, sc := range scs {
+		f, err := listenFile(dir, sc)
+		if err != nil {
+			us.close()
+			return nil, errors.Wrapf(err, "listen on %s", sc)
+		}
+		us.configs = append(us.configs, sc)
+		us.files = append(us.files, f)
+	}
+	return us, nil
+}
+
+// listenFile returns a listening socket as file. The listener itself is closed, the socket stays open with the file.
+func listenFile(dir string, sc SocketConfig) (*os.File, error) {
+	switch sc.Network {
+	case "tcp":
+		l, err := net.Listen("tcp", sc.Address)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		return l.(*net.TCPListener).File()
+	case "unix":
+		path := sc.Address
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		// remove a stale socket of a former run
+		os.Remove(path)
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		l.SetUnlinkOnClose(false)
+		defer l.Close()
+		return l.File()
+	default:
+		return nil, errors.Errorf("invalid network %q", sc.Network)
+	}
+}
+
+// matches returns true, if the sockets are opened for scs
+func (us *unitSockets) matches(scs []SocketConfig) bool {
+	if us == nil {
+		return len(scs) == 0
+	}
+	if len(us.configs) != len(scs) {
+		return false
+	}
+	for i, sc := range scs {
+		if us.configs[i] != sc {
+			return false
+		}
+	}
+	return true
+}
+
+func (us *unitSockets) names() []string {
+	if us == nil {
+		return nil
+	}
+	var names []string
+	for _, sc := range us.configs {
+		names = append(names, sc.name())
+	}
+	return names
+}
+
+func (us *unitSockets) addresses() []string {
+	if us == nil {
+		return nil
+	}
+	var addrs []string
+	for _, sc := range us.configs {
+		addrs = append(addrs, sc.String())
+	}
+	return addrs
+}
+
+func (us *unitSockets) close() {
+	if us == nil {
+		return
+	}
+	for _, f := range us.files {
+		f.Close()
+	}
+	us.files = nil
+}
+
+// listenEnv returns the env of the LISTEN_FDS convention without LISTEN_PID, which is set by the listenPIDWrapper
+func listenEnv(names []string) []string {
+	return []string{
+		fmt.Sprintf("LISTEN_FDS=%d", len(names)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(names, ":")),
+	}
+}
+
+// runSocketActivation starts lazy units, when a connection is pending on one of their sockets
+func (c *Controller) runSocketActivation(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		files, owners := c.lazyListeners()
+		if len(files) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(socketPollInterval):
+			}
+			continue
+		}
+		ready, err := pollListeners(files, socketPollInterval)
+		if err != nil {
+			log.Errorf("controller: poll sockets: %v", err)
+		}
+		failed := err != nil
+		activated := map[*controllerUnit]bool{}
+		for _, i := range ready {
+			cu := owners[i]
+			if activated[cu] {
+				continue
+			}
+			activated[cu] = true
+			if err := c.activate(cu); err != nil {
+				log.Errorf("controller: activate unit %q: %v", cu.name, err)
+				failed = true
+			}
+		}
+		if failed {
+			// pending connections would make the next poll return immediately
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(socketPollInterval):
+			}
+		}
+	}
+}
+
+// lazyListeners returns the sockets of the lazy units, which wait for their first connection, along with the owning units
+func (c *Controller) lazyListeners() (files []*os.File, owners []*controllerUnit) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, cu := range c.units {
+		if !cu.unit.Config.LazyStart || !cu.unit.Config.Enabled || cu.sockets == nil {
+			continue
+		}
+		// a crash-looping unit, or one stopped by the operator, has to be started explicitly
+		if cu.guard.IsStarted() || cu.guard.IsCrashLooping() || cu.guard.Status().StopRequested {
+			continue
+		}
+		for _, f := range cu.sockets.files {
+			files = append(files, f)
+			owners = append(owners, cu)
+		}
+	}
+	return files, owners
+}
+
+// activate starts the lazy unit cu
+func (c *Controller) activate(cu *controllerUnit) error {
+	if err := c.dependenciesReady(cu); err != nil {
+		return err
+	}
+	pid, err := cu.guard.Start()
+	if err != nil {
+		return err
+	}
+	log.Infof("controller: activated %q with PID %d on connection", cu.name, pid)
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package copr
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// pollListeners waits up to timeout for pending connections on the listen sockets files and returns the indices of the ready ones
+func pollListeners(files []*os.File, timeout time.Duration) ([]int, error) {
+	fds := make([]unix.PollFd, len(files))
+	for i, f := range files {
+		fds[i] = unix.PollFd{Fd: int32(f.Fd()), Events: unix.POLLIN}
+	}
+	_, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err != nil && err != unix.EINTR {
+		return nil, errors.Wrap(err, "poll")
+	}
+	var ready []int
+	for i, fd := range fds {
+		if fd.Revents&unix.POLLIN != 0 {
+			ready = append(ready, i)
+		}
+	}
+	return ready, nil
+}
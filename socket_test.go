@@ -0,0 +1,140 @@
+package copr
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuardListenFiles(t *testing.T) {
+	dir := t.TempDir()
+	us, err := openSockets(dir, []SocketConfig{
+		{Network: "tcp", Address: "127.0.0.1:0", Name: "web"},
+		{Network: "unix", Address: "ctl.sock"},
+	})
+	assertNoErr(t, err, "open sockets")
+	defer us.close()
+
+	out := NewLogRing(10)
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", `echo "fds=$LISTEN_FDS names=$LISTEN_FDNAMES pid-ok=$([ "$LISTEN_PID" = "$$" ] && echo yes) fd4=$(readlink /proc/$$/fd/4 | cut -d: -f1)"`),
+		WithStdOut(out),
+		WithRestartMode(RestartNever),
+		WithListenFiles(us.files, us.names()),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	_, err = guard.Start()
+	assertNoErr(t, err, "guard-start")
+	time.Sleep(200 * time.Millisecond)
+	assertEqual(t, true, guard.IsCompleted(), "completed")
+	lines, _ := out.Tail(10)
+	want := "fds=2 names=web:unix-ctl.sock pid-ok=yes fd4=socket"
+	found := false
+	for _, line := range lines {
+		found = found || line == want
+	}
+	assertEqual(t, true, found, "output %q in %v", want, lines)
+}
+
+func TestSocketActivation(t *testing.T) {
+	dir := t.TempDir()
+	uc := UnitConfig{
+		Enabled:   true,
+		Program:   "sh",
+		Sockets:   []SocketConfig{{Network: "tcp", Address: "127.0.0.1:0"}},
+		LazyStart: true,
+	}
+	us, err := openSockets(dir, uc.Sockets)
+	assertNoErr(t, err, "open sockets")
+	defer us.close()
+	l, err := net.FileListener(us.files[0])
+	assertNoErr(t, err, "file listener")
+	addr := l.Addr().String()
+	l.Close()
+
+	guard, err := NewGuard(
+		"/bin/sh",
+		WithArgs("-c", "exec sleep 60"),
+		WithListenFiles(us.files, us.names()),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	cu := &controllerUnit{
+		unit:    Unit{Name: "lazy", Dir: dir, Config: uc},
+		name:    "lazy",
+		guard:   guard,
+		sockets: us,
+	}
+	c := &Controller{statCache: NewUnitStatsCache(), units: []*controllerUnit{cu}}
+
+	files, owners := c.lazyListeners()
+	assertEqual(t, 1, len(files), "lazy listeners")
+	ready, err := pollListeners(files, 50*time.Millisecond)
+	assertNoErr(t, err, "poll")
+	assertEqual(t, 0, len(ready), "ready without connection")
+
+	conn, err := net.Dial("tcp", addr)
+	assertNoErr(t, err, "dial %q", addr)
+	defer conn.Close()
+	ready, err = pollListeners(files, time.Second)
+	assertNoErr(t, err, "poll")
+	assertEqual(t, 1, len(ready), "ready with pending connection")
+
+	assertNoErr(t, c.activate(owners[ready[0]]), "activate")
+	assertEqual(t, true, guard.IsStarted(), "started on connection")
+	files, _ = c.lazyListeners()
+	assertEqual(t, 0, len(files), "lazy listeners of started unit")
+
+	// an explicitly stopped unit isn't activated by connections anymore
+	resp := c.stop("lazy")
+	assertNoErr(t, resp.Error(), "stop")
+	assertEqual(t, false, guard.IsStarted(), "started after stop")
+	conn2, err := net.Dial("tcp", addr)
+	assertNoErr(t, err, "dial %q", addr)
+	defer conn2.Close()
+	files, _ = c.lazyListeners()
+	assertEqual(t, 0, len(files), "lazy listeners of stopped unit")
+	assertEqual(t, false, guard.IsStarted(), "started after connecting to stopped unit")
+
+	// until it is started explicitly
+	resp = c.start(context.Background(), "lazy")
+	assertNoErr(t, resp.Error(), "start")
+	assertEqual(t, false, guard.Status().StopRequested, "stop requested after start")
+	assertNoErr(t, guard.Stop(), "stop guard")
+}
+
+func TestSocketActivationStopIdle(t *testing.T) {
+	guard, err := NewGuard("/bin/sh", WithArgs("-c", "exec sleep 60"))
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+
+	cu := &controllerUnit{
+		unit:  Unit{Name: "lazy", Config: UnitConfig{Enabled: true, LazyStart: true}},
+		name:  "lazy",
+		guard: guard,
+	}
+	c := &Controller{statCache: NewUnitStatsCache(), units: []*controllerUnit{cu}}
+	assertEqual(t, false, guard.Status().StopRequested, "stop requested initially")
+
+	// stopping a lazy unit, which was never activated, keeps it from being activated
+	resp := c.stop("lazy")
+	assertNoErr(t, resp.Error(), "stop")
+	assertEqual(t, true, guard.Status().StopRequested, "stop requested after stop")
+	assertEqual(t, false, guard.IsStarted(), "started after stop")
+
+	resp = c.start(context.Background(), "lazy")
+	assertNoErr(t, resp.Error(), "start")
+	assertEqual(t, false, guard.Status().StopRequested, "stop requested after start")
+	assertNoErr(t, guard.Stop(), "stop guard")
+}
@@ -0,0 +1,90 @@
+package copr
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	startupProbeInterval = 200 * time.Millisecond
+	startupStderrLines   = 10
+)
+
+// StartupProbe returns nil, when the started process is ready
+type StartupProbe func(ctx context.Context) error
+
+// WithMinUptime lets Start wait, until the process ran for d. If it exits before, Start fails.
+func WithMinUptime(d time.Duration) GuardOption {
+	return func(g *Guard) error {
+		g.minUptime = d
+		return nil
+	}
+}
+
+// WithStartupProbe lets Start wait, until probe passes. If it doesn't pass within timeout, the process is stopped and Start fails.
+func WithStartupProbe(probe StartupProbe, timeout time.Duration) GuardOption {
+	return func(g *Guard) error {
+		if probe != nil && timeout <= 0 {
+			return errors.Errorf("startup probe needs a timeout")
+		}
+		g.startupProbe = probe
+		g.startupTimeout = timeout
+		return nil
+	}
+}
+
+func (g *Guard) hasStartupCheck() bool {
+	return g.minUptime > 0 || g.startupProbe != nil
+}
+
+// startupError describes a failed startup along with the last lines the process wrote to stderr
+func startupError(stderr *LogRing, pattern string, args ...any) error {
+	var lines []string
+	if stderr != nil {
+		lines, _ = stderr.Tail(startupStderrLines)
+	}
+	if len(lines) == 0 {
+		return errors.Errorf(pattern, args...)
+	}
+	return errors.Errorf(pattern+"; last stderr lines:\n%s", append(args, strings.Join(lines, "\n"))...)
+}
+
+func (uc UnitConfig) validateStartup() error {
+	if uc.MinUptimeSec < 0 {
+		return errors.Errorf("min-uptime-sec must not be negative")
+	}
+	if uc.StartupTimeoutSec < 0 {
+		return errors.Errorf("startup-timeout-sec must not be negative")
+	}
+	if uc.StartupTimeoutSec > 0 {
+		if uc.Health == nil {
+			return errors.Errorf("startup-timeout-sec requires a health check")
+		}
+		if uc.MinUptimeSec >= uc.StartupTimeoutSec {
+			return errors.Errorf("min-uptime-sec must be less than startup-timeout-sec")
+		}
+	}
+	return nil
+}
+
+// startupOpts returns the guard options of the startup checks. The health check serves as startup probe.
+func (c *Controller) startupOpts(cu *controllerUnit) []GuardOption {
+	uc := cu.unit.Config
+	opts := []GuardOption{
+		WithMinUptime(time.Duration(uc.MinUptimeSec) * time.Second),
+		WithStartupProbe(nil, 0),
+	}
+	if uc.StartupTimeoutSec > 0 && uc.Health != nil {
+		hc := cu.expander().expandHealth(*uc.Health)
+		probe := newHealthProbe(hc, cu.unit.Dir, c.unitEnv(cu), cu.unit.Credential)
+		opts[1] = WithStartupProbe(func(ctx context.Context) error {
+			cctx, cancel := context.WithTimeout(ctx, hc.timeout())
+			defer cancel()
+			return probe(cctx)
+		}, time.Duration(uc.StartupTimeoutSec)*time.Second)
+	}
+	return opts
+}
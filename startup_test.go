@@ -0,0 +1,68 @@
+package copr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestGuardStartupChecks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newGuard := func(script string, opts ...GuardOption) *Guard {
+		opts = append([]GuardOption{
+			WithArgs("-c", script),
+			WithStdErr(NewLogRing(10)),
+			WithRestartAfter(10 * time.Millisecond),
+		}, opts...)
+		guard, err := NewGuard("/bin/sh", opts...)
+		assertNoErr(t, err, "new-guard")
+		go guard.RunCtx(ctx)
+		return guard
+	}
+
+	// exits before the min uptime
+	guard := newGuard("echo 'invalid config' >&2; sleep 0.1; exit 3", WithMinUptime(time.Second))
+	_, err := guard.Start()
+	assertErr(t, err, "start of failing process")
+	assertEqual(t, true, strings.Contains(err.Error(), "code=3"), "exit code in %q", err)
+	assertEqual(t, true, strings.Contains(err.Error(), "invalid config"), "stderr in %q", err)
+	<-time.After(100 * time.Millisecond)
+	assertEqual(t, GuardStatusFailed, guard.Status().RunningState, "status after failed startup")
+
+	// survives the min uptime
+	guard = newGuard("exec sleep 60", WithMinUptime(200*time.Millisecond))
+	t0 := time.Now()
+	_, err = guard.Start()
+	assertNoErr(t, err, "start")
+	assertEqual(t, true, time.Since(t0) >= 200*time.Millisecond, "start waited for min uptime")
+	assertEqual(t, true, guard.IsStarted(), "started")
+
+	// passes the startup probe
+	dir := t.TempDir()
+	readyFile := filepath.Join(dir, "ready")
+	probe := func(ctx context.Context) error {
+		if _, err := os.Stat(readyFile); err != nil {
+			return errors.Errorf("not ready")
+		}
+		return nil
+	}
+	guard = newGuard("sleep 0.3; touch "+readyFile+"; exec sleep 60", WithStartupProbe(probe, 2*time.Second))
+	_, err = guard.Start()
+	assertNoErr(t, err, "start with probe")
+	assertEqual(t, true, guard.IsStarted(), "started with probe")
+
+	// doesn't pass the startup probe in time
+	os.Remove(readyFile)
+	guard = newGuard("exec sleep 60", WithStartupProbe(probe, 500*time.Millisecond), WithStopSignal(syscall.SIGKILL))
+	_, err = guard.Start()
+	assertErr(t, err, "start with failing probe")
+	assertEqual(t, true, strings.Contains(err.Error(), "not ready after"), "timeout in %q", err)
+	assertEqual(t, GuardStatusFailed, guard.Status().RunningState, "status after probe timeout")
+}
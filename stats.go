@@ -3,6 +3,8 @@ package copr
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,18 +16,42 @@ import (
 
 // Stats is a collection of typical process stats
 type StatsDescriptor struct {
-	Name         string
-	Enabled      bool
-	Started      bool
-	PID          int
-	RSS          uint64
-	VM           uint64
-	CPUPerc      float64
-	MEMPerc      float64
-	RLimitSoftFD uint64
-	RLimitHardFD uint64
-	NumFD        uint64
-	StartedAt    time.Time
+	Name            string
+	Unit            string
+	Instance        int
+	Enabled         bool
+	Started         bool
+	State           GuardRunningState
+	Desired         DesiredState
+	PID             int
+	RSS             uint64
+	VM              uint64
+	CPUPerc         float64
+	MEMPerc         float64
+	RLimitSoftFD    uint64
+	RLimitHardFD    uint64
+	NumFD           uint64
+	RLimits         []RLimit
+	StartedAt       time.Time
+	Health          HealthStatus
+	HealthFailures  int
+	HealthCheckedAt time.Time
+	HealthError     string
+	LastExit        *ExitInfo
+	ExitHistory     []ExitInfo
+	Cgroup          string
+	CgroupMemory    uint64
+	CgroupCPUPerc   float64
+	OOMKills        uint64
+	WatchdogEvents  []WatchdogEvent
+	Schedule        string
+	LastRun         time.Time
+	LastResult      string
+	NextRun         time.Time
+	SkippedRuns     int
+	Strays          []StrayProcess
+	ReapedOrphans   int
+	Sockets         []string
 }
 
 const (
@@ -34,6 +60,31 @@ const (
 	gB = 1024 * mB
 )
 
+// parseSize parses sizes like "512", "64K", "1.5G" or "2GB" to bytes
+func parseSize(s string) (uint64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(str, "K"):
+		mult = kB
+	case strings.HasSuffix(str, "M"):
+		mult = mB
+	case strings.HasSuffix(str, "G"):
+		mult = gB
+	case strings.HasSuffix(str, "T"):
+		mult = 1024 * gB
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	return uint64(v * mult), nil
+}
+
 func memH(v float64) string {
 	switch {
 	case v < kB:
@@ -63,19 +114,94 @@ func (s StatsDescriptor) String() string {
 		return fmt.Sprintf("%q: disabled", s.Name)
 	}
 	if !s.Started {
-		return fmt.Sprintf("%q: enabled - not started", s.Name)
+		state := "not started"
+		switch s.State {
+		case GuardStatusCrashLooping, GuardStatusCompleted, GuardStatusFailed:
+			state = string(s.State)
+		case GuardStatusRunningStopped:
+			if s.Desired != "" && s.Desired != DesiredStopped {
+				state = "restart pending"
+			}
+		}
+		if s.LastExit != nil {
+			return fmt.Sprintf("%q: enabled - %s, last-exit: %s%s%s", s.Name, state, s.LastExit, s.scheduleString(), s.socketsString())
+		}
+		return fmt.Sprintf("%q: enabled - %s%s%s", s.Name, state, s.scheduleString(), s.socketsString())
 	}
 
-	return fmt.Sprintf("%q: enabled=%t, started=%t, pid=%d, rss=%s, vm=%s, cpu=%.1f, mem=%.1f sl=%d, hl=%d, fds=%d, startedAt=%s, uptime=%s",
+	str := fmt.Sprintf("%q: enabled=%t, started=%t, pid=%d, rss=%s, vm=%s, cpu=%.1f, mem=%.1f sl=%d, hl=%d, fds=%d, startedAt=%s, uptime=%s",
 		s.Name, s.Enabled, s.Started,
 		s.PID, s.RSSH(), s.VMH(), s.CPUPerc, s.MEMPerc, s.RLimitSoftFD, s.RLimitHardFD, s.NumFD,
 		s.StartedAt.Local().Format("02.01.2006 15:04:05"), time.Since(s.StartedAt).Round(1*time.Second),
 	)
+	if s.Health != "" {
+		str += fmt.Sprintf(", health=%s", s.Health)
+		if s.HealthError != "" {
+			str += fmt.Sprintf(" (%d failures: %s)", s.HealthFailures, s.HealthError)
+		}
+	}
+	if s.Cgroup != "" {
+		str += fmt.Sprintf(", cg-mem=%s, cg-cpu=%.1f, oom-kills=%d", memH(float64(s.CgroupMemory)), s.CgroupCPUPerc, s.OOMKills)
+	}
+	if len(s.Strays) > 0 || s.ReapedOrphans > 0 {
+		str += fmt.Sprintf(", strays=%d, reaped-orphans=%d", len(s.Strays), s.ReapedOrphans)
+	}
+	if s.Desired == DesiredStopped {
+		// a stop is in progress or the kill timed out
+		str += ", desired=stopped"
+	}
+	if s.LastExit != nil {
+		str += fmt.Sprintf(", last-exit: %s", s.LastExit)
+	}
+	return str + s.scheduleString() + s.socketsString()
+}
+
+func (s StatsDescriptor) socketsString() string {
+	if len(s.Sockets) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", sockets=%s", strings.Join(s.Sockets, ","))
+}
+
+func (s StatsDescriptor) scheduleString() string {
+	if s.Schedule == "" {
+		return ""
+	}
+	str := fmt.Sprintf(", schedule=%q", s.Schedule)
+	if !s.LastRun.IsZero() {
+		str += fmt.Sprintf(", last-run=%s (%s)", s.LastRun.Local().Format("02.01.2006 15:04:05"), s.LastResult)
+	}
+	if !s.NextRun.IsZero() {
+		str += fmt.Sprintf(", next-run=%s", s.NextRun.Local().Format("02.01.2006 15:04:05"))
+	}
+	if s.SkippedRuns > 0 {
+		str += fmt.Sprintf(", skipped=%d", s.SkippedRuns)
+	}
+	return str
+}
+
+type scheduleState struct {
+	expr       string
+	lastRun    time.Time
+	lastResult string
+	nextRun    time.Time
+	skipped    int
+}
+
+type healthState struct {
+	status    HealthStatus
+	failures  int
+	checkedAt time.Time
+	err       string
 }
 
 type stats struct {
 	name         string
+	unit         string
+	instance     int
 	enabled      bool
+	state        GuardRunningState
+	desired      DesiredState
 	pid          int
 	rss          uint64
 	vm           uint64
@@ -84,25 +210,63 @@ type stats struct {
 	rlimitsoftfd uint64
 	rlimithardfd uint64
 	numfd        uint64
+	rlimits      []RLimit
 	startedAt    time.Time
+	health       healthState
+	lastExit     *ExitInfo
+	exits        []ExitInfo
+	watchdog     []WatchdogEvent
+	schedule     scheduleState
+	cgroup       string
+	cgroupStats  cgroupStats
+	cgroupCPU    float64
+	strays       []StrayProcess
+	reaped       int
+	sockets      []string
 	proc         *process.Process
 	_lastCPUPerc float64
+	// cpu usage of the cgroup at the last collect
+	_lastCgroupUsage uint64
+	_lastCgroupAt    time.Time
 }
 
 func (s stats) descriptor() StatsDescriptor {
 	return StatsDescriptor{
-		Name:         s.name,
-		Enabled:      s.enabled,
-		Started:      s.pid > -1,
-		PID:          s.pid,
-		RSS:          s.rss,
-		VM:           s.vm,
-		CPUPerc:      s.cpuperc,
-		MEMPerc:      s.memperc,
-		RLimitSoftFD: s.rlimitsoftfd,
-		RLimitHardFD: s.rlimithardfd,
-		NumFD:        s.numfd,
-		StartedAt:    s.startedAt,
+		Name:            s.name,
+		Unit:            s.unit,
+		Instance:        s.instance,
+		Enabled:         s.enabled,
+		Started:         s.pid > -1,
+		State:           s.state,
+		Desired:         s.desired,
+		PID:             s.pid,
+		RSS:             s.rss,
+		VM:              s.vm,
+		CPUPerc:         s.cpuperc,
+		MEMPerc:         s.memperc,
+		RLimitSoftFD:    s.rlimitsoftfd,
+		RLimitHardFD:    s.rlimithardfd,
+		NumFD:           s.numfd,
+		StartedAt:       s.startedAt,
+		Health:          s.health.status,
+		HealthFailures:  s.health.failures,
+		HealthCheckedAt: s.health.checkedAt,
+		HealthError:     s.health.err,
+		LastExit:        s.lastExit,
+		ExitHistory:     append([]ExitInfo{}, s.exits...),
+		Cgroup:          s.cgroup,
+		CgroupMemory:    s.cgroupStats.memoryCurrent,
+		CgroupCPUPerc:   s.cgroupCPU,
+		OOMKills:        s.cgroupStats.oomKills,
+		WatchdogEvents:  append([]WatchdogEvent{}, s.watchdog...),
+		Schedule:        s.schedule.expr,
+		LastRun:         s.schedule.lastRun,
+		LastResult:      s.schedule.lastResult,
+		NextRun:         s.schedule.nextRun,
+		SkippedRuns:     s.schedule.skipped,
+		Strays:          append([]StrayProcess{}, s.strays...),
+		ReapedOrphans:   s.reaped,
+		Sockets:         append([]string{}, s.sockets...),
 	}
 }
 
@@ -115,7 +279,10 @@ func (s *stats) collect() error {
 	if err != nil {
 		return errors.Wrap(err, "virtual memory")
 	}
-	rls, _ := s.proc.Rlimit()
+	rls, err := getRLimits(int(s.proc.Pid))
+	if err != nil {
+		log.Warnf("PID %d, get-rlimits: %v", s.proc.Pid, err)
+	}
 	numFDs, err := s.proc.NumFDs()
 	if err != nil {
 		numFDs = 0
@@ -127,10 +294,11 @@ func (s *stats) collect() error {
 	s.memperc = float64(pmi.RSS) / float64(vm.Total) * 100.0
 	s.numfd = uint64(numFDs)
 
+	s.rlimits = rls
 	for _, rl := range rls {
-		if rl.Resource == process.RLIMIT_NOFILE {
-			s.rlimitsoftfd = uint64(rl.Soft)
-			s.rlimithardfd = uint64(rl.Hard)
+		if rl.Resource == RLimitNoFile {
+			s.rlimitsoftfd = rl.Soft
+			s.rlimithardfd = rl.Hard
 		}
 	}
 	//
@@ -145,6 +313,25 @@ func (s *stats) collect() error {
 	return nil
 }
 
+// collectCgroup reads the usage of the unit cgroup. The cpu percentage is computed from the usage since the last collect.
+func (s *stats) collectCgroup() error {
+	cs, err := readCgroupStats(s.cgroup)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !s._lastCgroupAt.IsZero() && cs.cpuUsageUsec >= s._lastCgroupUsage {
+		elapsed := now.Sub(s._lastCgroupAt).Microseconds()
+		if elapsed > 0 {
+			s.cgroupCPU = float64(cs.cpuUsageUsec-s._lastCgroupUsage) / float64(elapsed) * 100.0
+		}
+	}
+	s._lastCgroupUsage = cs.cpuUsageUsec
+	s._lastCgroupAt = now
+	s.cgroupStats = cs
+	return nil
+}
+
 func NewUnitStatsCache() *UnitStatsCache {
 	return &UnitStatsCache{
 		unitStats: make(map[string]*stats),
@@ -160,6 +347,12 @@ func (c *UnitStatsCache) collect() error {
 	c.Lock()
 	defer c.Unlock()
 	for _, s := range c.unitStats {
+		if s.cgroup != "" {
+			err := s.collectCgroup()
+			if err != nil {
+				log.Warnf("%q collect cgroup: %v", s.name, err)
+			}
+		}
 		if s.proc == nil {
 			continue
 		}
@@ -181,6 +374,17 @@ func (c *UnitStatsCache) statsDescriptor(unit string) (StatsDescriptor, error) {
 	return s.descriptor(), nil
 }
 
+// statsDescriptors returns the stats of the unit instance with name unit or of all instances of unit
+func (c *UnitStatsCache) statsDescriptors(unit string) []StatsDescriptor {
+	var sds []StatsDescriptor
+	for _, sd := range c.allStatsDescriptors() {
+		if sd.Name == unit || sd.Unit == unit {
+			sds = append(sds, sd)
+		}
+	}
+	return sds
+}
+
 func (c *UnitStatsCache) allStatsDescriptors() []StatsDescriptor {
 	c.RLock()
 	defer c.RUnlock()
@@ -203,6 +407,43 @@ func (c *UnitStatsCache) add(name string, enabled bool) {
 	}
 }
 
+func (c *UnitStatsCache) remove(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.unitStats, name)
+}
+
+func (c *UnitStatsCache) setInstance(name string, unit string, instance int) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.unit = unit
+		us.instance = instance
+	}
+}
+
+func (c *UnitStatsCache) changed(name string, rs GuardRunningState, pid int) {
+	switch rs {
+	case GuardStatusRunningStarted:
+		c.started(name, pid)
+	case GuardStatusRunningStopped, GuardStatusCrashLooping, GuardStatusCompleted, GuardStatusFailed:
+		c.stopped(name)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.state = rs
+	}
+}
+
+func (c *UnitStatsCache) desiredChanged(name string, d DesiredState) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.desired = d
+	}
+}
+
 func (c *UnitStatsCache) started(name string, pid int) {
 	c.Lock()
 	defer c.Unlock()
@@ -229,6 +470,131 @@ func (c *UnitStatsCache) stopped(name string) {
 	}
 }
 
+func (c *UnitStatsCache) exited(name string, ei ExitInfo) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.lastExit = &ei
+		us.exits = append(us.exits, ei)
+		if len(us.exits) > maxExitHistory {
+			us.exits = us.exits[len(us.exits)-maxExitHistory:]
+		}
+	}
+}
+
+func (c *UnitStatsCache) watchdogEvent(name string, ev WatchdogEvent) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.watchdog = append(us.watchdog, ev)
+		if len(us.watchdog) > maxWatchdogEvents {
+			us.watchdog = us.watchdog[len(us.watchdog)-maxWatchdogEvents:]
+		}
+	}
+}
+
+// setSchedule resets the schedule stats of the unit. us is nil, if the unit isn't scheduled
+func (c *UnitStatsCache) setSchedule(name string, us *unitSchedule) {
+	var ss scheduleState
+	if us != nil {
+		ss = scheduleState{
+			expr:    us.cron.String(),
+			nextRun: us.next,
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.unitStats[name]; ok {
+		ss.lastRun, ss.lastResult = s.schedule.lastRun, s.schedule.lastResult
+		s.schedule = ss
+	}
+}
+
+func (c *UnitStatsCache) scheduleNext(name string, next time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.unitStats[name]; ok {
+		s.schedule.nextRun = next
+	}
+}
+
+func (c *UnitStatsCache) scheduleRun(name string, at time.Time, result string) {
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.unitStats[name]; ok {
+		s.schedule.lastRun = at
+		s.schedule.lastResult = result
+	}
+}
+
+func (c *UnitStatsCache) scheduleResult(name string, result string) {
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.unitStats[name]; ok {
+		s.schedule.lastResult = result
+	}
+}
+
+func (c *UnitStatsCache) scheduleSkipped(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if s, ok := c.unitStats[name]; ok {
+		s.schedule.skipped++
+	}
+}
+
+func (c *UnitStatsCache) healthChanged(name string, m *healthMonitor) {
+	var hs healthState
+	if m != nil {
+		status, failures, checkedAt, err := m.state()
+		hs = healthState{
+			status:    status,
+			failures:  failures,
+			checkedAt: checkedAt,
+		}
+		if err != nil {
+			hs.err = err.Error()
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.health = hs
+	}
+}
+
+func (c *UnitStatsCache) setCgroup(name string, path string) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.cgroup = path
+	}
+}
+
+func (c *UnitStatsCache) setSockets(name string, sockets []string) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.sockets = sockets
+	}
+}
+
+func (c *UnitStatsCache) setStrays(name string, strays []StrayProcess) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.strays = strays
+	}
+}
+
+func (c *UnitStatsCache) orphanReaped(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if us, ok := c.unitStats[name]; ok {
+		us.reaped++
+	}
+}
+
 func (c *UnitStatsCache) enabled(name string) {
 	c.Lock()
 	defer c.Unlock()
@@ -0,0 +1,115 @@
+package copr
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// spawned are the processes, which coprd started itself and waits for. The reaper must not reap them.
+var spawned = &spawnRegistry{pids: map[int]bool{}}
+
+type spawnRegistry struct {
+	mx   sync.Mutex
+	pids map[int]bool
+}
+
+// startProcess starts cmd and registers its process as spawned. For the reaper, start and registration are atomic.
+func startProcess(cmd *exec.Cmd) error {
+	spawned.mx.Lock()
+	defer spawned.mx.Unlock()
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	spawned.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// waitProcess waits for the process of cmd, which was started with startProcess
+func waitProcess(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	spawned.mx.Lock()
+	defer spawned.mx.Unlock()
+	delete(spawned.pids, cmd.Process.Pid)
+	return err
+}
+
+// StrayProcess is a descendant of a unit, which was orphaned and reparented to coprd
+type StrayProcess struct {
+	PID     int
+	PGID    int
+	Command string
+}
+
+func (sp StrayProcess) String() string {
+	return fmt.Sprintf("pid=%d, pgid=%d, command=%q", sp.PID, sp.PGID, sp.Command)
+}
+
+// reapedOrphan is an orphan, which exited and was reaped by coprd
+type reapedOrphan struct {
+	StrayProcess
+	status string
+}
+
+// reapOrphans reaps the exited orphans among the children of coprd and returns them along with the ones still running
+func reapOrphans() (reaped []reapedOrphan, strays []StrayProcess, err error) {
+	spawned.mx.Lock()
+	defer spawned.mx.Unlock()
+	children, err := childProcesses(os.Getpid())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ps := range children {
+		if spawned.pids[ps.pid] {
+			continue
+		}
+		sp := StrayProcess{PID: ps.pid, PGID: ps.pgid, Command: ps.comm}
+		if !ps.zombie() {
+			strays = append(strays, sp)
+			continue
+		}
+		ws, err := reapProcess(ps.pid)
+		if err != nil {
+			continue
+		}
+		reaped = append(reaped, reapedOrphan{StrayProcess: sp, status: waitStatusString(ws)})
+	}
+	return reaped, strays, nil
+}
+
+// processGroups maps the process groups of unit processes to the instance names. A group is kept after the
+// main process exited, as long as orphans of the group are alive.
+type processGroups struct {
+	mx     sync.Mutex
+	groups map[int]string
+}
+
+func newProcessGroups() *processGroups {
+	return &processGroups{groups: map[int]string{}}
+}
+
+func (pg *processGroups) add(pgid int, name string) {
+	pg.mx.Lock()
+	defer pg.mx.Unlock()
+	pg.groups[pgid] = name
+}
+
+func (pg *processGroups) unit(pgid int) (string, bool) {
+	pg.mx.Lock()
+	defer pg.mx.Unlock()
+	name, ok := pg.groups[pgid]
+	return name, ok
+}
+
+// prune removes the groups, which aren't in use anymore
+func (pg *processGroups) prune(inUse func(pgid int) bool) {
+	pg.mx.Lock()
+	defer pg.mx.Unlock()
+	for pgid := range pg.groups {
+		if !inUse(pgid) {
+			delete(pg.groups, pgid)
+		}
+	}
+}
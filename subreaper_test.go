@@ -0,0 +1,55 @@
+package copr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReapOrphans(t *testing.T) {
+	assertNoErr(t, setChildSubreaper(), "set child subreaper")
+	c := &Controller{statCache: NewUnitStatsCache(), groups: newProcessGroups()}
+	c.statCache.add("forker", true)
+	guard, err := NewGuard(
+		"/bin/sh",
+		// the subshells exit immediately and orphan their sleeps
+		WithArgs("-c", "(sleep 0.2 &); (sleep 60 &); exec sleep 60"),
+		WithKillMode(KillModeGroup),
+		WithKillTimeout(time.Second),
+		WithOnChange(func(rs GuardRunningState, pid int) {
+			c.statCache.changed("forker", rs, pid)
+			if rs == GuardStatusRunningStarted {
+				c.groups.add(pid, "forker")
+			}
+		}),
+	)
+	assertNoErr(t, err, "new-guard")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.RunCtx(ctx)
+	c.units = []*controllerUnit{{name: "forker", guard: guard}}
+
+	pid, err := guard.Start()
+	assertNoErr(t, err, "guard-start")
+	time.Sleep(100 * time.Millisecond)
+	c.reapOrphans()
+	sd, _ := c.statCache.statsDescriptor("forker")
+	assertEqual(t, 2, len(sd.Strays), "strays")
+	assertEqual(t, pid, sd.Strays[0].PGID, "stray process group")
+
+	time.Sleep(300 * time.Millisecond)
+	c.reapOrphans()
+	sd, _ = c.statCache.statsDescriptor("forker")
+	assertEqual(t, 1, len(sd.Strays), "strays after the short one exited")
+	assertEqual(t, 1, sd.ReapedOrphans, "reaped orphans")
+
+	// the group kill also kills the remaining stray
+	assertNoErr(t, guard.Stop(), "guard-stop")
+	time.Sleep(100 * time.Millisecond)
+	c.reapOrphans()
+	sd, _ = c.statCache.statsDescriptor("forker")
+	assertEqual(t, 0, len(sd.Strays), "strays after stop")
+	assertEqual(t, 2, sd.ReapedOrphans, "reaped orphans after stop")
+	_, ok := c.groups.unit(pid)
+	assertEqual(t, false, ok, "pruned process group")
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/mazzegi/log"
@@ -15,17 +16,265 @@ import (
 // Unit represenst on Service/Program, considered to reside in one directory
 type UnitConfig struct {
 	//Name            string   `json:"name"`
-	Enabled         bool     `json:"enabled"`
-	Program         string   `json:"program"`
-	Args            []string `json:"args,omitempty"`
-	Env             []string `json:"env,omitempty"`
-	RestartAfterSec int      `json:"restart-after-sec"`
+	Enabled         bool                 `json:"enabled"`
+	Program         string               `json:"program"`
+	Args            []string             `json:"args,omitempty"`
+	Env             []string             `json:"env,omitempty"`
+	RestartAfterSec int                  `json:"restart-after-sec"`
+	Restart         string               `json:"restart,omitempty"`
+	StopSignal      string               `json:"stop-signal,omitempty"`
+	StopTimeoutSec  int                  `json:"stop-timeout-sec,omitempty"`
+	KillMode        string               `json:"kill-mode,omitempty"`
+	Health          *HealthConfig        `json:"health,omitempty"`
+	DependsOn       []string             `json:"depends-on,omitempty"`
+	After           []string             `json:"after,omitempty"`
+	Logs            *LogConfig           `json:"logs,omitempty"`
+	RLimits         *RLimitsConfig       `json:"rlimits,omitempty"`
+	Cgroup          *CgroupConfig        `json:"cgroup,omitempty"`
+	User            string               `json:"user,omitempty"`
+	Group           string               `json:"group,omitempty"`
+	Groups          []string             `json:"groups,omitempty"`
+	RestartPolicy   *RestartPolicyConfig `json:"restart-policy,omitempty"`
+	Watchdog        []WatchdogRule       `json:"watchdog,omitempty"`
+	Schedule        string               `json:"schedule,omitempty"`
+	ScheduleOverlap string               `json:"schedule-overlap,omitempty"`
+	Instances       int                  `json:"instances,omitempty"`
+	BasePort        int                  `json:"base-port,omitempty"`
+	Hooks           *HooksConfig         `json:"hooks,omitempty"`
+	Sockets         []SocketConfig       `json:"sockets,omitempty"`
+	LazyStart       bool                 `json:"lazy-start,omitempty"`
+	Deploy          *DeployConfig        `json:"deploy,omitempty"`
+	ReloadSignal    string               `json:"reload-signal,omitempty"`
+	// MinUptimeSec is the time a started process has to keep running, before the start is successful
+	MinUptimeSec int `json:"min-uptime-sec,omitempty"`
+	// StartupTimeoutSec is the time a started process has to pass its health check, before the start fails
+	StartupTimeoutSec int `json:"startup-timeout-sec,omitempty"`
+	// AllowedSignals replaces the default signals, which can be sent to the unit on request. The exit of the unit
+	// on such a signal is handled like a crash.
+	AllowedSignals []string `json:"allowed-signals,omitempty"`
+}
+
+// RestartPolicyConfig configures the backoff between automatic restarts and the crash-loop detection
+type RestartPolicyConfig struct {
+	Backoff       string  `json:"backoff,omitempty"`
+	MaxDelaySec   int     `json:"max-delay-sec,omitempty"`
+	Factor        float64 `json:"factor,omitempty"`
+	Jitter        float64 `json:"jitter,omitempty"`
+	MaxRestarts   int     `json:"max-restarts,omitempty"`
+	WindowSec     int     `json:"window-sec,omitempty"`
+	ResetAfterSec int     `json:"reset-after-sec,omitempty"`
+}
+
+func (uc UnitConfig) Validate() error {
+	if uc.Program == "" {
+		return errors.Errorf("no program")
+	}
+	if uc.RestartAfterSec < 0 {
+		return errors.Errorf("restart-after-sec must not be negative")
+	}
+	switch RestartMode(uc.Restart) {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return errors.Errorf("invalid restart mode %q", uc.Restart)
+	}
+	if uc.StopSignal != "" {
+		if _, err := parseSignal(uc.StopSignal); err != nil {
+			return errors.Wrap(err, "stop-signal")
+		}
+	}
+	if uc.ReloadSignal != "" {
+		if _, err := parseSignal(uc.ReloadSignal); err != nil {
+			return errors.Wrap(err, "reload-signal")
+		}
+	}
+	for _, s := range uc.AllowedSignals {
+		if _, err := parseSignal(s); err != nil {
+			return errors.Wrap(err, "allowed-signals")
+		}
+	}
+	if uc.StopTimeoutSec < 0 {
+		return errors.Errorf("stop-timeout-sec must not be negative")
+	}
+	switch KillMode(uc.KillMode) {
+	case "", KillModeProcess, KillModeGroup, KillModeMixed:
+	default:
+		return errors.Errorf("invalid kill-mode %q", uc.KillMode)
+	}
+	if uc.Health != nil {
+		if err := uc.Health.Validate(); err != nil {
+			return errors.Wrap(err, "health")
+		}
+	}
+	if uc.Logs != nil {
+		if err := uc.Logs.Validate(); err != nil {
+			return errors.Wrap(err, "logs")
+		}
+	}
+	if uc.RLimits != nil {
+		if err := uc.RLimits.Validate(); err != nil {
+			return errors.Wrap(err, "rlimits")
+		}
+	}
+	if uc.Cgroup != nil {
+		if err := uc.Cgroup.Validate(); err != nil {
+			return errors.Wrap(err, "cgroup")
+		}
+	}
+	for i, r := range uc.Watchdog {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "watchdog rule %d", i)
+		}
+	}
+	if uc.Hooks != nil {
+		if err := uc.Hooks.Validate(); err != nil {
+			return errors.Wrap(err, "hooks")
+		}
+	}
+	for i, sc := range uc.Sockets {
+		if err := sc.Validate(); err != nil {
+			return errors.Wrapf(err, "socket %d", i)
+		}
+	}
+	if uc.LazyStart && len(uc.Sockets) == 0 {
+		return errors.Errorf("lazy-start requires sockets")
+	}
+	if uc.LazyStart && uc.Schedule != "" {
+		return errors.Errorf("lazy-start and schedule are exclusive")
+	}
+	if err := uc.validateInstances(); err != nil {
+		return err
+	}
+	if err := uc.validateDeploy(); err != nil {
+		return errors.Wrap(err, "deploy")
+	}
+	if err := uc.validateStartup(); err != nil {
+		return err
+	}
+	if uc.Schedule != "" {
+		if _, err := ParseCronSchedule(uc.Schedule); err != nil {
+			return errors.Wrap(err, "schedule")
+		}
+	}
+	switch ScheduleOverlap(uc.ScheduleOverlap) {
+	case "", ScheduleSkip, ScheduleQueue:
+	default:
+		return errors.Errorf("invalid schedule-overlap %q", uc.ScheduleOverlap)
+	}
+	if rp := uc.RestartPolicy; rp != nil {
+		switch BackoffKind(rp.Backoff) {
+		case "", BackoffFixed, BackoffExponential:
+		default:
+			return errors.Errorf("restart-policy: invalid backoff %q", rp.Backoff)
+		}
+		if rp.MaxDelaySec < 0 || rp.MaxRestarts < 0 || rp.WindowSec < 0 || rp.ResetAfterSec < 0 {
+			return errors.Errorf("restart-policy: values must not be negative")
+		}
+		if rp.Jitter < 0 || rp.Jitter > 1 {
+			return errors.Errorf("restart-policy: jitter must be in [0, 1]")
+		}
+	}
+	return nil
+}
+
+func (uc UnitConfig) stopSignal() syscall.Signal {
+	sig, err := parseSignal(uc.StopSignal)
+	if err != nil {
+		return syscall.SIGINT
+	}
+	return sig
+}
+
+func (uc UnitConfig) reloadSignal() syscall.Signal {
+	sig, err := parseSignal(uc.ReloadSignal)
+	if err != nil {
+		return syscall.SIGHUP
+	}
+	return sig
+}
+
+// signalAllowed checks, if sig can be sent to the unit on request
+func (uc UnitConfig) signalAllowed(sig syscall.Signal) bool {
+	if len(uc.AllowedSignals) == 0 {
+		for _, asig := range defaultAllowedSignals {
+			if asig == sig {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range uc.AllowedSignals {
+		if asig, err := parseSignal(s); err == nil && asig == sig {
+			return true
+		}
+	}
+	return false
+}
+
+func (uc UnitConfig) stopTimeout() time.Duration {
+	if uc.StopTimeoutSec == 0 {
+		return defaultKillTimeout
+	}
+	return time.Duration(uc.StopTimeoutSec) * time.Second
+}
+
+func (uc UnitConfig) killMode() KillMode {
+	if uc.KillMode == "" {
+		return KillModeProcess
+	}
+	return KillMode(uc.KillMode)
+}
+
+func (uc UnitConfig) rlimits() []RLimit {
+	if uc.RLimits == nil {
+		return nil
+	}
+	return uc.RLimits.rlimits()
+}
+
+// credential resolves user and groups. It returns nil, if none are configured.
+func (uc UnitConfig) credential() (*Credential, error) {
+	return resolveCredential(uc.User, uc.Group, uc.Groups)
+}
+
+func (uc UnitConfig) restartMode() RestartMode {
+	if uc.Restart == "" && uc.Schedule != "" {
+		// scheduled runs are started by the scheduler only
+		return RestartNever
+	}
+	if uc.Restart == "" {
+		return RestartAlways
+	}
+	return RestartMode(uc.Restart)
+}
+
+func (uc UnitConfig) restartPolicy() RestartPolicy {
+	p := DefaultRestartPolicy()
+	rp := uc.RestartPolicy
+	if rp == nil {
+		return p
+	}
+	if rp.Backoff != "" {
+		p.Backoff = BackoffKind(rp.Backoff)
+	}
+	if rp.Factor > 0 {
+		p.Factor = rp.Factor
+	}
+	if rp.ResetAfterSec > 0 {
+		p.ResetAfter = time.Duration(rp.ResetAfterSec) * time.Second
+	}
+	p.MaxDelay = time.Duration(rp.MaxDelaySec) * time.Second
+	p.Jitter = rp.Jitter
+	p.MaxRestarts = rp.MaxRestarts
+	p.Window = time.Duration(rp.WindowSec) * time.Second
+	return p
 }
 
 type Unit struct {
 	Dir    string
 	Name   string
 	Config UnitConfig
+	// Credential is resolved from the config at load time. It's nil, if the unit runs as coprd
+	Credential *Credential
 }
 
 func LoadUnits(dir string, secs *Secrets) (*Units, error) {
@@ -93,10 +342,19 @@ func (us *Units) loadUnit(unit string) (Unit, error) {
 	if err != nil {
 		return Unit{}, errors.Wrapf(err, "failed to json-decode unit file %q", unitFile)
 	}
+	err = uc.Validate()
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "invalid unit file %q", unitFile)
+	}
+	cred, err := uc.credential()
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "resolve credential in unit file %q", unitFile)
+	}
 	return Unit{
-		Name:   unit,
-		Dir:    filepath.Join(us.dir, unit),
-		Config: uc,
+		Name:       unit,
+		Dir:        filepath.Join(us.dir, unit),
+		Config:     uc,
+		Credential: cred,
 	}, nil
 }
 
@@ -132,6 +390,10 @@ func (us *Units) Create(unit string, dir string) (Unit, error) {
 	if err != nil {
 		return Unit{}, errors.Wrapf(err, "chmod program %q to 0755", prg)
 	}
+	err = chownUnitDir(u)
+	if err != nil {
+		return Unit{}, err
+	}
 
 	us.units = append(us.units, u)
 
@@ -139,8 +401,107 @@ func (us *Units) Create(unit string, dir string) (Unit, error) {
 }
 
 func (us *Units) Update(unit string, dir string) (Unit, error) {
-	//archive old unit dir
+	return us.update(unit, dir, "")
+}
+
+// UpdateKeepPrevious updates the unit like Update, but keeps the previous unit dir for a rollback with Restore.
+// Processes of the previous version keep running in the moved dir.
+func (us *Units) UpdateKeepPrevious(unit string, dir string) (u Unit, prevDir string, err error) {
+	prevDir = filepath.Join(us.dir, archiveDir, fmt.Sprintf("%s_%s_%03d.prev", unit, time.Now().Format("20060102150405"), rand.Intn(1000)))
+	u, err = us.update(unit, dir, prevDir)
+	return u, prevDir, err
+}
+
+// Restore replaces the unit dir by prevDir, which was kept by UpdateKeepPrevious
+func (us *Units) Restore(unit string, prevDir string) (Unit, error) {
+	unitDir := filepath.Join(us.dir, unit)
+	unitLogsDir := filepath.Join(unitDir, logsDir)
+	if _, err := os.Stat(unitLogsDir); err == nil {
+		err = os.Rename(unitLogsDir, filepath.Join(prevDir, logsDir))
+		if err != nil {
+			return Unit{}, errors.Wrapf(err, "move logs %q -> %q", unitLogsDir, prevDir)
+		}
+	}
+	err := os.RemoveAll(unitDir)
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "remove unitdir %q", unitDir)
+	}
+	err = os.Rename(prevDir, unitDir)
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "rename %q -> %q", prevDir, unitDir)
+	}
+	u, err := us.loadUnit(unit)
+	if err != nil {
+		return Unit{}, errors.Wrapf(err, "load-unit %q", unit)
+	}
+	us.replace(u)
+	return u, nil
+}
+
+// Remove deletes the unit dir. With keepArchive, the dir is archived before and the path of the archive is returned.
+func (us *Units) Remove(unit string, keepArchive bool) (archive string, err error) {
+	unitDir := filepath.Join(us.dir, unit)
+	if keepArchive {
+		archive = filepath.Join(us.dir, archiveDir, fmt.Sprintf("%s_%s_%03d.removed.zip", unit, time.Now().Format("20060102150405"), rand.Intn(1000)))
+		archF, err := os.Create(archive)
+		if err != nil {
+			return "", errors.Wrapf(err, "create archive in %q", archive)
+		}
+		defer archF.Close()
+		err = ZipDir(archF, unitDir)
+		if err != nil {
+			os.Remove(archive)
+			return "", errors.Wrapf(err, "create zip in %q", archive)
+		}
+	}
+	err = os.RemoveAll(unitDir)
+	if err != nil {
+		return archive, errors.Wrapf(err, "remove unitdir %q", unitDir)
+	}
+	for i, u := range us.units {
+		if u.Name == unit {
+			us.units = append(us.units[:i], us.units[i+1:]...)
+			break
+		}
+	}
+	return archive, nil
+}
+
+// DiscardPrevious removes a previous unit dir, which was kept by UpdateKeepPrevious
+func (us *Units) DiscardPrevious(prevDir string) error {
+	return errors.Wrapf(os.RemoveAll(prevDir), "remove %q", prevDir)
+}
+
+func (us *Units) replace(u Unit) {
+	for i, ou := range us.units {
+		if ou.Name == u.Name {
+			us.units[i] = u
+		}
+	}
+}
+
+// update replaces the unit dir by dir. The old dir is moved to prevDir, or removed if prevDir is empty.
+func (us *Units) update(unit string, dir string, prevDir string) (Unit, error) {
 	unitDir := filepath.Join(us.dir, unit)
+
+	// keep the logs out of the archive and move them over to the new unit dir
+	unitLogsDir := filepath.Join(unitDir, logsDir)
+	tmpLogsDir := filepath.Join(us.dir, archiveDir, fmt.Sprintf("%s_logs_%s", unit, time.Now().Format("20060102150405")))
+	if _, err := os.Stat(unitLogsDir); err == nil {
+		err = os.Rename(unitLogsDir, tmpLogsDir)
+		if err != nil {
+			return Unit{}, errors.Wrapf(err, "move logs %q -> %q", unitLogsDir, tmpLogsDir)
+		}
+		defer func() {
+			os.RemoveAll(unitLogsDir)
+			err := os.Rename(tmpLogsDir, unitLogsDir)
+			if err != nil {
+				log.Errorf("move logs %q -> %q: %v", tmpLogsDir, unitLogsDir, err)
+			}
+		}()
+	}
+
+	//archive old unit dir
 	archUnitFile := filepath.Join(us.dir, archiveDir, fmt.Sprintf("%s_%s_%03d.bak.zip", unit, time.Now().Format("20060102150405"), rand.Intn(1000)))
 	archF, err := os.Create(archUnitFile)
 	if err != nil {
@@ -151,9 +512,16 @@ func (us *Units) Update(unit string, dir string) (Unit, error) {
 	if err != nil {
 		return Unit{}, errors.Wrapf(err, "create zip in %q", archUnitFile)
 	}
-	err = os.RemoveAll(unitDir)
-	if err != nil {
-		return Unit{}, errors.Wrapf(err, "remove old unitdir %q", unitDir)
+	if prevDir != "" {
+		err = os.Rename(unitDir, prevDir)
+		if err != nil {
+			return Unit{}, errors.Wrapf(err, "move old unitdir %q -> %q", unitDir, prevDir)
+		}
+	} else {
+		err = os.RemoveAll(unitDir)
+		if err != nil {
+			return Unit{}, errors.Wrapf(err, "remove old unitdir %q", unitDir)
+		}
 	}
 
 	//
@@ -171,29 +539,51 @@ func (us *Units) Update(unit string, dir string) (Unit, error) {
 	if err != nil {
 		return Unit{}, errors.Wrapf(err, "chmod program %q to 0755", prg)
 	}
-
-	for i, u := range us.units {
-		if u.Name == unit {
-			us.units[i] = u
-		}
+	err = chownUnitDir(u)
+	if err != nil {
+		return Unit{}, err
 	}
+
+	us.replace(u)
 	return u, nil
 }
 
-func ValidateUnitDir(dir string) error {
+// chownUnitDir hands the unit dir over to the user of the unit, if it doesn't run as coprd
+func chownUnitDir(u Unit) error {
+	if u.Credential == nil || u.Credential.isCurrent() {
+		return nil
+	}
+	return chownDir(u.Dir, *u.Credential)
+}
+
+// ReadUnitConfig reads and validates the unit config in dir
+func ReadUnitConfig(dir string) (UnitConfig, error) {
 	unitFile := filepath.Join(dir, "copr.unit.json")
 	if _, err := os.Stat(unitFile); err != nil {
-		return errors.Wrapf(err, "no unit file %q", unitFile)
+		return UnitConfig{}, errors.Wrapf(err, "no unit file %q", unitFile)
 	}
 	f, err := os.Open(unitFile)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open unit file %q", unitFile)
+		return UnitConfig{}, errors.Wrapf(err, "failed to open unit file %q", unitFile)
 	}
 	defer f.Close()
 	var uc UnitConfig
 	err = json.NewDecoder(f).Decode(&uc)
 	if err != nil {
-		return errors.Wrapf(err, "failed to json-decode unit file %q", unitFile)
+		return UnitConfig{}, errors.Wrapf(err, "failed to json-decode unit file %q", unitFile)
 	}
-	return nil
+	err = uc.Validate()
+	if err != nil {
+		return UnitConfig{}, errors.Wrapf(err, "invalid unit file %q", unitFile)
+	}
+	_, err = uc.credential()
+	if err != nil {
+		return UnitConfig{}, errors.Wrapf(err, "resolve credential in unit file %q", unitFile)
+	}
+	return uc, nil
+}
+
+func ValidateUnitDir(dir string) error {
+	_, err := ReadUnitConfig(dir)
+	return err
 }
@@ -0,0 +1,221 @@
+package copr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type WatchdogMetric string
+
+const (
+	// WatchdogRSS compares the RSS with a size like "1.5G"
+	WatchdogRSS WatchdogMetric = "rss"
+	// WatchdogCPU compares the CPU usage in percent
+	WatchdogCPU WatchdogMetric = "cpu"
+	// WatchdogFD compares the number of open files in percent of the soft limit
+	WatchdogFD WatchdogMetric = "fd"
+)
+
+type WatchdogAction string
+
+const (
+	WatchdogNotify  WatchdogAction = "notify"
+	WatchdogRestart WatchdogAction = "restart"
+)
+
+const maxWatchdogEvents = 20
+
+// WatchdogRule triggers an action, if a metric is above a threshold for a number of samples and/or a duration
+type WatchdogRule struct {
+	Metric string `json:"metric"`
+	// Above is a size for rss and a percentage for cpu and fd
+	Above string `json:"above"`
+	// Samples is the number of consecutive stats samples, which must breach the threshold. Default is 1
+	Samples int `json:"samples,omitempty"`
+	// ForSec is the minimum duration of the breach
+	ForSec int `json:"for-sec,omitempty"`
+	// Action is either notify (default) or restart
+	Action string `json:"action,omitempty"`
+}
+
+func (r WatchdogRule) Validate() error {
+	switch WatchdogMetric(r.Metric) {
+	case WatchdogRSS, WatchdogCPU, WatchdogFD:
+	default:
+		return errors.Errorf("invalid metric %q", r.Metric)
+	}
+	if _, err := r.threshold(); err != nil {
+		return err
+	}
+	if r.Samples < 0 || r.ForSec < 0 {
+		return errors.Errorf("samples and for-sec must not be negative")
+	}
+	switch WatchdogAction(r.Action) {
+	case "", WatchdogNotify, WatchdogRestart:
+	default:
+		return errors.Errorf("invalid action %q", r.Action)
+	}
+	return nil
+}
+
+func (r WatchdogRule) threshold() (float64, error) {
+	if WatchdogMetric(r.Metric) == WatchdogRSS {
+		v, err := parseSize(r.Above)
+		if err != nil {
+			return 0, errors.Wrap(err, "above")
+		}
+		return float64(v), nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(r.Above), "%"), 64)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("above: invalid percentage %q", r.Above)
+	}
+	return v, nil
+}
+
+func (r WatchdogRule) samples() int {
+	if r.Samples == 0 {
+		return 1
+	}
+	return r.Samples
+}
+
+func (r WatchdogRule) action() WatchdogAction {
+	if r.Action == "" {
+		return WatchdogNotify
+	}
+	return WatchdogAction(r.Action)
+}
+
+func (r WatchdogRule) String() string {
+	s := fmt.Sprintf("%s > %s for %d samples", r.Metric, r.Above, r.samples())
+	if r.ForSec > 0 {
+		s += fmt.Sprintf(" and %s", time.Duration(r.ForSec)*time.Second)
+	}
+	return s
+}
+
+// WatchdogEvent records a triggered watchdog rule with the values, which triggered it
+type WatchdogEvent struct {
+	Time      time.Time
+	Rule      string
+	Metric    WatchdogMetric
+	Value     float64
+	Threshold float64
+	Samples   int
+	Since     time.Time
+	Action    WatchdogAction
+	PID       int
+	Error     string
+}
+
+func (ev WatchdogEvent) String() string {
+	value, threshold := fmt.Sprintf("%.1f%%", ev.Value), fmt.Sprintf("%.1f%%", ev.Threshold)
+	if ev.Metric == WatchdogRSS {
+		value, threshold = memH(ev.Value), memH(ev.Threshold)
+	}
+	s := fmt.Sprintf("%s: %s=%s > %s for %d samples (%s), pid=%d -> %s",
+		ev.Time.Local().Format("02.01.2006 15:04:05"), ev.Metric, value, threshold,
+		ev.Samples, ev.Time.Sub(ev.Since).Round(time.Second), ev.PID, ev.Action)
+	if ev.Error != "" {
+		s += fmt.Sprintf(" (%s)", ev.Error)
+	}
+	return s
+}
+
+// metricValue returns the current value of metric. ok is false, if it isn't available
+func metricValue(metric WatchdogMetric, sd StatsDescriptor) (v float64, ok bool) {
+	switch metric {
+	case WatchdogRSS:
+		return float64(sd.RSS), true
+	case WatchdogCPU:
+		return sd.CPUPerc, true
+	case WatchdogFD:
+		if sd.RLimitSoftFD == 0 || sd.RLimitSoftFD == RLimitInfinity {
+			return 0, false
+		}
+		return float64(sd.NumFD) / float64(sd.RLimitSoftFD) * 100.0, true
+	default:
+		return 0, false
+	}
+}
+
+type watchdogBreach struct {
+	samples int
+	since   time.Time
+}
+
+// watchdog evaluates the rules of a unit on each stats sample
+type watchdog struct {
+	rules      []WatchdogRule
+	thresholds []float64
+	breaches   []watchdogBreach
+	pid        int
+}
+
+func newWatchdog(rules []WatchdogRule) *watchdog {
+	w := &watchdog{
+		rules:      rules,
+		thresholds: make([]float64, len(rules)),
+		breaches:   make([]watchdogBreach, len(rules)),
+	}
+	for i, r := range rules {
+		// rules are validated with the unit config
+		w.thresholds[i], _ = r.threshold()
+	}
+	return w
+}
+
+func (w *watchdog) reset() {
+	for i := range w.breaches {
+		w.breaches[i] = watchdogBreach{}
+	}
+}
+
+// check evaluates the rules against sd and returns events for the triggered rules.
+// A triggered rule starts counting from scratch.
+func (w *watchdog) check(sd StatsDescriptor, now time.Time) []WatchdogEvent {
+	if !sd.Started {
+		w.reset()
+		return nil
+	}
+	if sd.PID != w.pid {
+		// samples of a former process don't count
+		w.reset()
+		w.pid = sd.PID
+	}
+	var evs []WatchdogEvent
+	for i, r := range w.rules {
+		metric := WatchdogMetric(r.Metric)
+		v, ok := metricValue(metric, sd)
+		if !ok || v <= w.thresholds[i] {
+			w.breaches[i] = watchdogBreach{}
+			continue
+		}
+		b := &w.breaches[i]
+		if b.samples == 0 {
+			b.since = now
+		}
+		b.samples++
+		if b.samples < r.samples() || now.Sub(b.since) < time.Duration(r.ForSec)*time.Second {
+			continue
+		}
+		evs = append(evs, WatchdogEvent{
+			Time:      now,
+			Rule:      r.String(),
+			Metric:    metric,
+			Value:     v,
+			Threshold: w.thresholds[i],
+			Samples:   b.samples,
+			Since:     b.since,
+			Action:    r.action(),
+			PID:       sd.PID,
+		})
+		*b = watchdogBreach{}
+	}
+	return evs
+}
@@ -0,0 +1,74 @@
+package copr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	w := newWatchdog([]WatchdogRule{
+		{Metric: "rss", Above: "1K", Samples: 3, Action: "restart"},
+		{Metric: "cpu", Above: "90", ForSec: 10},
+		{Metric: "fd", Above: "50%"},
+	})
+	start := time.Now()
+	sample := func(sec int, rss uint64, cpu float64, fds uint64) []WatchdogEvent {
+		return w.check(StatsDescriptor{
+			Started:      true,
+			PID:          42,
+			RSS:          rss,
+			CPUPerc:      cpu,
+			NumFD:        fds,
+			RLimitSoftFD: 100,
+		}, start.Add(time.Duration(sec)*time.Second))
+	}
+
+	assertEqual(t, 0, len(sample(0, 2*kB, 95, 10)), "first breach")
+	assertEqual(t, 0, len(sample(5, 2*kB, 95, 10)), "second breach")
+	evs := sample(10, 3*kB, 95, 10)
+	assertEqual(t, 2, len(evs), "events after 3 samples and 10 seconds")
+	assertEqual(t, WatchdogRSS, evs[0].Metric, "rss metric")
+	assertEqual(t, WatchdogRestart, evs[0].Action, "rss action")
+	assertEqual(t, float64(3*kB), evs[0].Value, "rss value")
+	assertEqual(t, 3, evs[0].Samples, "rss samples")
+	assertEqual(t, WatchdogCPU, evs[1].Metric, "cpu metric")
+	assertEqual(t, WatchdogNotify, evs[1].Action, "cpu action")
+
+	assertEqual(t, 0, len(sample(15, 2*kB, 10, 10)), "counting starts from scratch")
+	assertEqual(t, 0, len(sample(20, 512, 95, 10)), "rss recovered")
+
+	evs = sample(25, 0, 0, 60)
+	assertEqual(t, 1, len(evs), "fd event")
+	assertEqual(t, float64(60), evs[0].Value, "fd percentage")
+
+	// a new process resets the samples
+	sample(30, 2*kB, 0, 0)
+	sample(35, 2*kB, 0, 0)
+	evs = w.check(StatsDescriptor{Started: true, PID: 43, RSS: 2 * kB}, start.Add(40*time.Second))
+	assertEqual(t, 0, len(evs), "samples of new pid")
+}
+
+func TestWatchdogRuleValidate(t *testing.T) {
+	tests := map[string]struct {
+		rule  WatchdogRule
+		valid bool
+	}{
+		"rss":            {rule: WatchdogRule{Metric: "rss", Above: "1.5G", Samples: 3}, valid: true},
+		"cpu":            {rule: WatchdogRule{Metric: "cpu", Above: "95", ForSec: 120, Action: "restart"}, valid: true},
+		"fd":             {rule: WatchdogRule{Metric: "fd", Above: "90%", Action: "notify"}, valid: true},
+		"unknown-metric": {rule: WatchdogRule{Metric: "disk", Above: "1"}},
+		"invalid-size":   {rule: WatchdogRule{Metric: "rss", Above: "much"}},
+		"invalid-action": {rule: WatchdogRule{Metric: "cpu", Above: "1", Action: "panic"}},
+		"negative":       {rule: WatchdogRule{Metric: "cpu", Above: "1", Samples: -1}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.rule.Validate()
+			if test.valid {
+				assertNoErr(t, err, "validate")
+			} else {
+				assertErr(t, err, "validate")
+			}
+		})
+	}
+}